@@ -1,19 +1,27 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"chat-microservice/internal/httpapi"
+	"chat-microservice/internal/metrics"
 	"chat-microservice/internal/middleware"
 	"chat-microservice/internal/repository"
+	"chat-microservice/internal/retry"
 	"chat-microservice/internal/service"
+	"chat-microservice/internal/tracing"
 	"chat-microservice/internal/ws"
 
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/time/rate"
 )
 
@@ -42,55 +50,268 @@ func main() {
 		mongoCollection = "messages"
 	}
 
-	maxRetries := 5
-	if retryStr := os.Getenv("RETRY_ATTEMPTS"); retryStr != "" {
-		if parsed, err := strconv.Atoi(retryStr); err == nil && parsed > 0 {
-			maxRetries = parsed
+	svcDefaults := service.DefaultConfig()
+	svcConfig := service.Config{
+		MaxRetries:  envInt("RETRY_ATTEMPTS", svcDefaults.MaxRetries),
+		DedupWindow: envDuration("DEDUP_WINDOW", svcDefaults.DedupWindow),
+
+		// Save attempts back off exponentially with jitter, from
+		// RETRY_INITIAL_INTERVAL up to RETRY_MAX_INTERVAL, and stop after
+		// RETRY_MAX_ELAPSED even if attempts are left
+		Retry: retry.Policy{
+			InitialInterval: envDuration("RETRY_INITIAL_INTERVAL", svcDefaults.Retry.InitialInterval),
+			MaxInterval:     envDuration("RETRY_MAX_INTERVAL", svcDefaults.Retry.MaxInterval),
+			Multiplier:      svcDefaults.Retry.Multiplier,
+			Jitter:          svcDefaults.Retry.Jitter,
+			MaxElapsedTime:  envDuration("RETRY_MAX_ELAPSED", svcDefaults.Retry.MaxElapsedTime),
+		},
+
+		SaveBatchSize:  envInt("SAVE_BATCH_SIZE", svcDefaults.SaveBatchSize),
+		SaveBatchDelay: envDuration("SAVE_BATCH_DELAY", svcDefaults.SaveBatchDelay),
+
+		DBWorkers:      envInt("DB_WORKERS", svcDefaults.DBWorkers),
+		DBQueueSize:    envInt("DB_QUEUE_SIZE", svcDefaults.DBQueueSize),
+		EnqueueTimeout: envDuration("ENQUEUE_TIMEOUT", svcDefaults.EnqueueTimeout),
+	}
+	if modeStr := os.Getenv("DELIVERY_MODE"); modeStr != "" {
+		mode, err := service.ParseDeliveryMode(modeStr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		svcConfig.DeliveryMode = mode
 	}
 
-	rps := rate.Limit(5)
-	if rpsStr := os.Getenv("RATE_LIMIT_RPS"); rpsStr != "" {
-		if parsed, err := strconv.ParseFloat(rpsStr, 64); err == nil && parsed > 0 {
-			rps = rate.Limit(parsed)
+	// Acknowledgement MongoDB gives for writes, e.g. MONGO_WRITE_CONCERN=majority
+	// with MONGO_JOURNAL=true to only accept messages that survive a failover.
+	// Queries and writes are also bounded by the read and write timeouts.
+	mongoDefaults := repository.DefaultMongoOptions()
+	mongoOptions := repository.MongoOptions{
+		WriteConcern: repository.WriteConcern{
+			W:        os.Getenv("MONGO_WRITE_CONCERN"),
+			Journal:  envBool("MONGO_JOURNAL", false),
+			WTimeout: envDuration("MONGO_WTIMEOUT", 0),
+		},
+		ReadTimeout:  envDuration("MONGO_READ_TIMEOUT", mongoDefaults.ReadTimeout),
+		WriteTimeout: envDuration("MONGO_WRITE_TIMEOUT", mongoDefaults.WriteTimeout),
+	}
+	if err := mongoOptions.WriteConcern.Validate(); err != nil {
+		log.Fatalf("MONGO_WRITE_CONCERN: %v", err)
+	}
+
+	defaultPolicy := envPolicy("RATE_LIMIT", 5, 10)
+	sendPolicy := envPolicy("RATE_LIMIT_SEND", 2, 5)
+	historyPolicy := envPolicy("RATE_LIMIT_HISTORY", 10, 20)
+	wsPolicy := envPolicy("RATE_LIMIT_WS", 1, 5)
+	ipPolicy := envPolicy("RATE_LIMIT_IP", 20, 40)
+	rateLimitIdleTTL := envDuration("RATE_LIMIT_IDLE_TTL", 10*time.Minute)
+	rateLimitBackend := os.Getenv("RATE_LIMIT_BACKEND")
+	trustProxyHeaders := envBool("TRUST_PROXY_HEADERS", false)
+
+	wsDefaults := ws.DefaultConfig()
+	wsConfig := ws.Config{
+		Shards:          envInt("HUB_SHARDS", wsDefaults.Shards),
+		WorkersPerShard: envInt("HUB_WORKERS_PER_SHARD", wsDefaults.WorkersPerShard),
+		ShardQueueSize:  envInt("HUB_SHARD_QUEUE_SIZE", wsDefaults.ShardQueueSize),
+		LogConnections:  envBool("HUB_LOG_CONNECTIONS", wsDefaults.LogConnections),
+
+		MaxFrameSize: int64(envInt("WS_MAX_FRAME_SIZE", int(wsDefaults.MaxFrameSize))),
+
+		PingPeriod:    envDuration("WS_PING_PERIOD", wsDefaults.PingPeriod),
+		PongWait:      envDuration("WS_PONG_WAIT", wsDefaults.PongWait),
+		WriteWait:     envDuration("WS_WRITE_WAIT", wsDefaults.WriteWait),
+		MinPingPeriod: envDuration("WS_MIN_PING_PERIOD", wsDefaults.MinPingPeriod),
+		MaxPingPeriod: envDuration("WS_MAX_PING_PERIOD", wsDefaults.MaxPingPeriod),
+
+		ConnFrameRate:  rate.Limit(envFloat("WS_FRAME_RPS", float64(wsDefaults.ConnFrameRate))),
+		ConnFrameBurst: envInt("WS_FRAME_BURST", wsDefaults.ConnFrameBurst),
+		UserFrameRate:  rate.Limit(envFloat("WS_USER_FRAME_RPS", float64(wsDefaults.UserFrameRate))),
+		UserFrameBurst: envInt("WS_USER_FRAME_BURST", wsDefaults.UserFrameBurst),
+		WarnAfter:      envInt("WS_FRAME_WARN_AFTER", wsDefaults.WarnAfter),
+		CloseAfter:     envInt("WS_FRAME_CLOSE_AFTER", wsDefaults.CloseAfter),
+		StrikeWindow:   envDuration("WS_FRAME_STRIKE_WINDOW", wsDefaults.StrikeWindow),
+
+		SendQueueSize:    envInt("WS_SEND_QUEUE_SIZE", wsDefaults.SendQueueSize),
+		OverflowPolicy:   wsDefaults.OverflowPolicy,
+		OverflowGrace:    envDuration("WS_OVERFLOW_GRACE", wsDefaults.OverflowGrace),
+		CoalesceMaxBytes: envInt("WS_COALESCE_MAX_BYTES", wsDefaults.CoalesceMaxBytes),
+
+		Compression:          envBool("WS_COMPRESSION", wsDefaults.Compression),
+		CompressionThreshold: envInt("WS_COMPRESSION_THRESHOLD", wsDefaults.CompressionThreshold),
+		CompressionLevel:     envInt("WS_COMPRESSION_LEVEL", wsDefaults.CompressionLevel),
+
+		WriteBatching:      envBool("WS_WRITE_BATCHING", wsDefaults.WriteBatching),
+		WriteBatchMaxBytes: envInt("WS_WRITE_BATCH_MAX_BYTES", wsDefaults.WriteBatchMaxBytes),
+
+		ReplayBufferSize: envInt("REPLAY_BUFFER_SIZE", wsDefaults.ReplayBufferSize),
+		ReplayWindow:     envDuration("REPLAY_WINDOW", wsDefaults.ReplayWindow),
+	}
+	if policyStr := os.Getenv("WS_OVERFLOW_POLICY"); policyStr != "" {
+		policy, err := ws.ParseOverflowPolicy(policyStr)
+		if err != nil {
+			log.Fatal(err)
 		}
+		wsConfig.OverflowPolicy = policy
+	}
+	if wsConfig.PongWait <= wsConfig.PingPeriod {
+		log.Fatalf("WS_PONG_WAIT (%s) must be longer than WS_PING_PERIOD (%s)", wsConfig.PongWait, wsConfig.PingPeriod)
+	}
+	if wsConfig.CompressionLevel > 9 {
+		log.Fatalf("WS_COMPRESSION_LEVEL must be between 1 and 9, got %d", wsConfig.CompressionLevel)
+	}
+
+	// Comma-separated list of origins allowed to call the API and open
+	// WebSockets from a browser, e.g. "https://app.example.com,https://*.example.com"
+	var allowedOrigins []string
+	if originsStr := os.Getenv("ALLOWED_ORIGINS"); originsStr != "" {
+		allowedOrigins = strings.Split(originsStr, ",")
+	}
+	cors, err := middleware.NewCORS(allowedOrigins)
+	if err != nil {
+		log.Fatalf("ALLOWED_ORIGINS: %v", err)
 	}
 
-	burst := 10
-	if burstStr := os.Getenv("RATE_LIMIT_BURST"); burstStr != "" {
-		if parsed, err := strconv.Atoi(burstStr); err == nil && parsed > 0 {
-			burst = parsed
+	// Spans of requests, broadcasts and saves go to TRACE_EXPORTER: none,
+	// stdout for local testing, or otlp to the collector at
+	// OTEL_EXPORTER_OTLP_ENDPOINT. TRACE_SAMPLE_RATIO of new traces are kept.
+	traceConfig := tracing.DefaultConfig()
+	if exporter := os.Getenv("TRACE_EXPORTER"); exporter != "" {
+		traceConfig.Exporter = exporter
+	}
+	if ratio := os.Getenv("TRACE_SAMPLE_RATIO"); ratio != "" {
+		parsed, err := strconv.ParseFloat(ratio, 64)
+		if err != nil || parsed < 0 || parsed > 1 {
+			log.Fatalf("TRACE_SAMPLE_RATIO must be between 0 and 1, got %q", ratio)
 		}
+		traceConfig.SampleRatio = parsed
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), traceConfig)
+	if err != nil {
+		log.Fatalf("failed to set up tracing: %v", err)
 	}
 
-	repo, err := repository.NewMongoRepository(mongoURI, mongoDB, mongoCollection)
+	mongoRepo, err := repository.NewMongoRepositoryWithOptions(mongoURI, mongoDB, mongoCollection, mongoOptions)
 	if err != nil {
 		log.Fatalf("failed to connect to MongoDB: %v", err)
 	}
 
-	hub := ws.NewHub()
-	svc := service.NewChatService(repo, hub, maxRetries)
+	// After BREAKER_FAILURES consecutive failures MongoDB isn't called for
+	// BREAKER_OPEN_TIMEOUT, so requests fail fast instead of timing out;
+	// 0 disables the breaker
+	var repo repository.Repository = repository.NewTracingRepository(mongoRepo)
+	breakerDefaults := repository.DefaultBreakerConfig()
+	if failures := envCount("BREAKER_FAILURES", breakerDefaults.FailureThreshold); failures > 0 {
+		repo = repository.NewCircuitBreaker(repo, repository.BreakerConfig{
+			FailureThreshold: failures,
+			OpenTimeout:      envDuration("BREAKER_OPEN_TIMEOUT", breakerDefaults.OpenTimeout),
+		})
+	}
+
+	hub := ws.NewHub(wsConfig)
+	appMetrics := metrics.New()
+	svcConfig.Metrics = appMetrics
+	svc := service.NewChatServiceWithConfig(repo, hub, svcConfig)
 
 	go hub.Run()
 
-	h := httpapi.NewHandler(svc)
+	h := httpapi.NewHandler(svc, cors.CheckOrigin)
 
 	authMiddleware := middleware.NewAuthMiddleware(jwtSecret)
-	rateLimiter := middleware.NewRateLimiter(rps, burst)
+
+	// With the redis backend every replica counts against the same buckets;
+	// the memory backend enforces limits per process
+	var userBackend, ipBackend middleware.Backend
+	switch rateLimitBackend {
+	case "redis":
+		redisAddr := os.Getenv("REDIS_ADDR")
+		if redisAddr == "" {
+			redisAddr = "localhost:6379"
+		}
+		redisClient := redis.NewClient(&redis.Options{
+			Addr:     redisAddr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+			DB:       envInt("REDIS_DB", 0),
+		})
+		defer redisClient.Close()
+		// Without the shared store every request fails open, so an instance
+		// that can't reach it isn't ready
+		h.AddReadinessCheck("redis", func(ctx context.Context) error {
+			return redisClient.Ping(ctx).Err()
+		})
+
+		shared := middleware.NewRedisBackend(redisClient, "chat:ratelimit:")
+		userBackend, ipBackend = shared, shared
+	case "", "memory":
+		userBackend = middleware.NewMemoryBackend(rateLimitIdleTTL)
+		ipBackend = middleware.NewMemoryBackend(rateLimitIdleTTL)
+	default:
+		log.Fatalf("unknown RATE_LIMIT_BACKEND %q", rateLimitBackend)
+	}
+
+	// Authenticated requests are limited per user, with stricter buckets for
+	// sending than for reading history. Everything reachable before the JWT is
+	// checked is limited per client IP.
+	rateLimiter := middleware.NewRateLimiterWithBackend(userBackend, defaultPolicy)
+	rateLimiter.SetRoutePolicy("/api/messages", sendPolicy)
+	rateLimiter.SetRoutePolicy("/api/messages/get", historyPolicy)
+	rateLimiter.SetRoutePolicy("/api/messages/range", historyPolicy)
+	rateLimiter.SetRoutePolicy("/ws", wsPolicy)
+	rateLimiter.SetRoutePolicy("/api/events", wsPolicy)
+
+	ipLimiter := middleware.NewRateLimiterWithBackend(ipBackend, ipPolicy)
+	ipLimiter.SetTrustProxyHeaders(trustProxyHeaders)
+	rateLimiter.SetMetrics(appMetrics, "user")
+	ipLimiter.SetMetrics(appMetrics, "ip")
+	hub.SetMetrics(appMetrics, "ws_frame")
 
 	mux := http.NewServeMux()
 
 	protectedAPI := http.NewServeMux()
 	protectedAPI.HandleFunc("/api/messages", h.HandleSendMessage)
 	protectedAPI.HandleFunc("/api/messages/get", h.HandleGetMessages)
+	protectedAPI.HandleFunc("/api/messages/range", h.HandleGetMessageRange)
+	// Fallback transports for clients that can't open a WebSocket
+	protectedAPI.HandleFunc("/api/events", h.HandleEvents)
+	protectedAPI.HandleFunc("/api/poll", h.HandlePoll)
+	protectedAPI.HandleFunc("GET /api/sessions", h.HandleListSessions)
+	protectedAPI.HandleFunc("DELETE /api/sessions/{id}", h.HandleDeleteSession)
+
+	// Operational endpoints; anything added here or under /api/admin/ requires
+	// the admin scope
+	adminAPI := http.NewServeMux()
+	adminAPI.HandleFunc("/api/connections", h.HandleGetUserConnections)
+	adminAPI.HandleFunc("/api/admin/rtt", h.HandleGetRTTStats)
+	adminAPI.HandleFunc("/api/admin/queues", h.HandleGetQueueStats)
+	adminAPI.HandleFunc("/api/admin/storage", h.HandleGetStorageStats)
+	adminAPI.HandleFunc("/api/admin/readiness", h.ReadinessDetails)
+	// Metrics reveal traffic and internals; Prometheus scrapes with an
+	// admin token
+	adminAPI.Handle("/metrics", appMetrics.Handler())
+	requireAdmin := middleware.RequireScopes(middleware.ScopeAdmin)
+	adminHandler := cors.Middleware(ipLimiter.IPMiddleware(authMiddleware.Verify(requireAdmin(rateLimiter.Middleware(adminAPI)))))
 
 	protectedWS := http.NewServeMux()
 	protectedWS.HandleFunc("/ws", h.HandleWebsocket)
 
 	mux.HandleFunc("/health", h.Health)
-	mux.Handle("/api/", authMiddleware.Verify(rateLimiter.Middleware(protectedAPI)))
-	mux.Handle("/ws", authMiddleware.Verify(protectedWS))
-	mux.HandleFunc("/api/connections", h.HandleGetUserConnections)
+	// Probes for orchestrators: /livez only says the process serves HTTP,
+	// /readyz checks MongoDB, the DB queue, the hub and Redis and answers
+	// with the overall status only
+	mux.HandleFunc("/livez", h.Livez)
+	mux.HandleFunc("/readyz", h.Readyz)
+	mux.Handle("/metrics", adminHandler)
+	mux.Handle("/api/", cors.Middleware(ipLimiter.IPMiddleware(authMiddleware.Verify(rateLimiter.Middleware(protectedAPI)))))
+	mux.Handle("/ws", ipLimiter.IPMiddleware(authMiddleware.Verify(rateLimiter.Middleware(protectedWS))))
+	mux.Handle("/api/connections", adminHandler)
+	mux.Handle("/api/admin/", adminHandler)
+
+	// HTTP metrics and spans are labeled with these routes; anything else
+	// is "other"
+	routes := []string{
+		"/health", "/livez", "/readyz", "/metrics", "/ws",
+		"/api/messages", "/api/messages/get", "/api/messages/range",
+		"/api/events", "/api/poll", "/api/sessions", "/api/sessions/{id}",
+		"/api/connections", "/api/admin/rtt", "/api/admin/queues", "/api/admin/storage", "/api/admin/readiness",
+	}
 
 	addr := ":8080"
 	if v := os.Getenv("PORT"); v != "" {
@@ -99,14 +320,86 @@ func main() {
 
 	server := &http.Server{
 		Addr:         addr,
-		Handler:      mux,
+		Handler:      middleware.RequestID(tracing.Middleware(routes, appMetrics.Middleware(routes, mux))),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
-	log.Printf("starting server on %s", addr)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("server failed: %v", err)
+	go func() {
+		log.Printf("starting server on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("server failed: %v", err)
+		}
+	}()
+
+	// Stop taking requests, store the messages still queued and flush the
+	// spans still buffered on the way out
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("server shutdown: %v", err)
+	}
+	svc.Stop()
+	hub.Stop()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Printf("flushing traces: %v", err)
+	}
+}
+
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return def
+}
+
+// envCount is envInt for settings where 0 means off
+func envCount(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed >= 0 {
+			return parsed
+		}
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return def
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := time.ParseDuration(v); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			return parsed
+		}
+	}
+	return def
+}
+
+// envPolicy reads <prefix>_RPS and <prefix>_BURST
+func envPolicy(prefix string, rps float64, burst int) middleware.Policy {
+	return middleware.Policy{
+		Rate:  rate.Limit(envFloat(prefix+"_RPS", rps)),
+		Burst: envInt(prefix+"_BURST", burst),
 	}
 }
@@ -128,7 +128,7 @@ async function getMessages(token) {
 }
 
 async function getUserConnections() {
-  const restClient = new ChatRestClient(SERVER_HTTP, '');
+  const restClient = new ChatRestClient(SERVER_HTTP, createToken('demo-admin', ['admin']));
   
   const usersInput = await question('\nEnter user IDs (comma-separated): ');
   const users = usersInput.split(',').map(u => u.trim());
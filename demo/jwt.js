@@ -2,9 +2,10 @@ import jwt from 'jsonwebtoken';
 
 const JWT_SECRET = 'your-jwt-secret';
 
-export function createToken(userId) {
+export function createToken(userId, roles = []) {
   const payload = {
     id: userId,
+    roles,
     iat: Math.floor(Date.now() / 1000),
     exp: Math.floor(Date.now() / 1000) + (60 * 60 * 24)
   };
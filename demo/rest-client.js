@@ -53,6 +53,7 @@ export class ChatRestClient {
         },
         {
           headers: {
+            'Authorization': `Bearer ${this.token}`,
             'Content-Type': 'application/json'
           }
         }
@@ -25,9 +25,18 @@ export class ChatWebSocketClient {
 
       this.ws.on('message', (data) => {
         try {
-          const message = JSON.parse(data.toString());
-          if (this.messageHandler) {
-            this.messageHandler(message);
+          // The server may batch several newline-delimited messages into one frame
+          const lines = data.toString().split('\n').filter(line => line.trim() !== '');
+          for (const line of lines) {
+            const message = JSON.parse(line);
+            // The first frame tells us our session id
+            if (message.type === 'hello') {
+              this.sessionId = message.session_id;
+              continue;
+            }
+            if (this.messageHandler) {
+              this.messageHandler(message);
+            }
           }
         } catch (error) {
           console.error('Failed to parse message:', error);
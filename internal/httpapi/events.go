@@ -0,0 +1,204 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chat-microservice/internal/middleware"
+	"chat-microservice/internal/ws"
+)
+
+const (
+	// sseKeepalive is how often an idle event stream sends a comment line so
+	// proxies don't time it out
+	sseKeepalive = 15 * time.Second
+	// sseRetry is the reconnect delay suggested to EventSource clients
+	sseRetry = 3 * time.Second
+
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+)
+
+// HandleEvents streams the caller's messages as Server-Sent Events for
+// clients that can't open a WebSocket. Each event carries an id; a client
+// reconnecting with Last-Event-ID gets the messages it missed replayed
+// first.
+func (h *Handler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	last, err := ws.ParseEventID(r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session, err := sessionFromRequest(r, ws.TransportSSE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if session.ID, err = resumedSessionID(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	hub := h.svc.Hub()
+	stream := ws.NewStream(userID, h.streamCapacity(), session)
+	hub.RegisterFrom(stream, last)
+	defer hub.Unregister(stream)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	// EventSource can't read response headers, so the session id comes as
+	// the first event
+	hello, _ := json.Marshal(sseHello{SessionID: stream.Session().ID})
+	fmt.Fprintf(w, "event: hello\ndata: %s\n\n", hello)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-stream.Ready():
+			events, closed := stream.Drain()
+			for _, ev := range events {
+				fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", ev.ID, ev.Data)
+			}
+			if err := rc.Flush(); err != nil || closed {
+				return
+			}
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+type sseHello struct {
+	SessionID string `json:"session_id"`
+}
+
+type pollEvent struct {
+	ID      string          `json:"id"`
+	Message json.RawMessage `json:"message"`
+}
+
+type pollResponse struct {
+	Events []pollEvent `json:"events"`
+	// Cursor is passed back as the cursor query parameter of the next poll
+	Cursor string `json:"cursor"`
+	// SessionID is passed back as the session_id query parameter so that
+	// consecutive polls are one session
+	SessionID string `json:"session_id"`
+}
+
+// HandlePoll is the long-polling fallback. It returns the caller's messages
+// after the cursor query parameter (or Last-Event-ID header) as soon as
+// there are any, or an empty list once the timeout (seconds, default 25)
+// expires. Each response carries the cursor and session id for the next
+// poll; messages arriving between polls are replayed from the hub's buffer.
+func (h *Handler) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cursorStr := r.URL.Query().Get("cursor")
+	if cursorStr == "" {
+		cursorStr = r.Header.Get("Last-Event-ID")
+	}
+	last, err := ws.ParseEventID(cursorStr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	session, err := sessionFromRequest(r, ws.TransportLongPoll)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if session.ID, err = resumedSessionID(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if timeoutStr := r.URL.Query().Get("timeout"); timeoutStr != "" {
+		if secs, err := strconv.Atoi(timeoutStr); err == nil && secs >= 0 {
+			timeout = time.Duration(secs) * time.Second
+			if timeout > maxPollTimeout {
+				timeout = maxPollTimeout
+			}
+		}
+	}
+
+	// Allow the poll to outlast the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(timeout + 10*time.Second))
+
+	hub := h.svc.Hub()
+	stream := ws.NewStream(userID, h.streamCapacity(), session)
+	cursor := hub.RegisterFrom(stream, last)
+
+	timer := time.NewTimer(timeout)
+	select {
+	case <-stream.Ready():
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+	timer.Stop()
+	hub.Unregister(stream)
+
+	events, _ := stream.Drain()
+	resp := pollResponse{Events: make([]pollEvent, 0, len(events))}
+	for _, ev := range events {
+		resp.Events = append(resp.Events, pollEvent{ID: ev.ID.String(), Message: ev.Data})
+		cursor = ev.ID
+	}
+	resp.Cursor = cursor.String()
+	resp.SessionID = stream.Session().ID
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// streamCapacity leaves room for a full replay on top of the regular queue
+func (h *Handler) streamCapacity() int {
+	cfg := h.svc.Hub().Config()
+	return cfg.SendQueueSize + cfg.ReplayBufferSize
+}
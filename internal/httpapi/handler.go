@@ -1,7 +1,10 @@
 package httpapi
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -9,6 +12,7 @@ import (
 	"time"
 
 	"chat-microservice/internal/middleware"
+	"chat-microservice/internal/repository"
 	"chat-microservice/internal/service"
 	"chat-microservice/internal/ws"
 	"chat-microservice/pkg/models"
@@ -19,22 +23,40 @@ import (
 type Handler struct {
 	svc      *service.ChatService
 	upgrader websocket.Upgrader
+	checks   []namedCheck // run by Readyz
 }
 
-func NewHandler(svc *service.ChatService) *Handler {
-	return &Handler{
+// NewHandler creates the HTTP handlers. checkOrigin decides which origins may
+// open a WebSocket; when nil only same-origin handshakes are accepted. Clients
+// choose their wire format through the subprotocols listed in ws.Subprotocols
+// and may negotiate permessage-deflate when the hub enables compression.
+func NewHandler(svc *service.ChatService, checkOrigin func(r *http.Request) bool) *Handler {
+	h := &Handler{
 		svc: svc,
 		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-			CheckOrigin:     func(r *http.Request) bool { return true },
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			CheckOrigin:       checkOrigin,
+			Subprotocols:      ws.Subprotocols(),
+			EnableCompression: svc.Hub().Config().Compression,
 		},
 	}
+	h.checks = h.defaultChecks()
+	return h
 }
 
+// Health reports the process as up. While the repository's circuit breaker
+// is open the status is "degraded" and the breaker state is included.
 func (h *Handler) Health(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{"status": "ok", "time": time.Now().Format(time.RFC3339)}
+	if stats, ok := h.svc.StorageStats(); ok {
+		resp["storage"] = stats.State
+		if stats.State != repository.BreakerClosed {
+			resp["status"] = "degraded"
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "time": time.Now().Format(time.RFC3339)})
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (h *Handler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
@@ -44,16 +66,57 @@ func (h *Handler) HandleWebsocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	conn, err := h.upgrader.Upgrade(w, r, nil)
+	// Clients on flaky networks may ask for their own ping interval and pong
+	// timeout, in seconds; the negotiated values are echoed in the response
+	pingPeriod, err := durationParam(r, "ping_interval")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pongWait, err := durationParam(r, "pong_timeout")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keepalive := ws.NegotiateKeepalive(h.svc.Hub().Config(), pingPeriod, pongWait)
+	session, err := sessionFromRequest(r, ws.TransportWebSocket)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	responseHeader := http.Header{}
+	responseHeader.Set("X-Ping-Interval", strconv.Itoa(int(keepalive.PingPeriod.Seconds())))
+	responseHeader.Set("X-Pong-Timeout", strconv.Itoa(int(keepalive.PongWait.Seconds())))
+	// The session id lets the client manage this connection from elsewhere.
+	// Browsers can't read the header and get it from the hello frame.
+	session.ID = ws.NewSessionID()
+	responseHeader.Set("X-Session-ID", session.ID)
+
+	conn, err := h.upgrader.Upgrade(w, r, responseHeader)
 	if err != nil {
 		log.Printf("upgrade: %v", err)
 		return
 	}
 
-	client := ws.NewClient(conn, h.svc.Hub(), userID)
+	client := ws.NewClientWithOptions(conn, h.svc.Hub(), userID, ws.ClientOptions{Keepalive: keepalive, Session: session})
 	client.Start()
 }
 
+// durationParam reads a query parameter holding a whole number of seconds.
+// A missing parameter yields zero.
+func durationParam(r *http.Request, name string) (time.Duration, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of seconds", name)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
 func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -69,6 +132,7 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 	var payload struct {
 		Participants []string `json:"participants"`
 		Content      string   `json:"content"`
+		ClientMsgID  string   `json:"client_msg_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
@@ -85,20 +149,92 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(payload.ClientMsgID) > maxClientMsgIDLength {
+		http.Error(w, fmt.Sprintf("client_msg_id must be at most %d characters", maxClientMsgIDLength), http.StatusBadRequest)
+		return
+	}
+
 	msg := &models.Message{
+		ClientMsgID:  payload.ClientMsgID,
 		Sender:       userID,
 		Content:      payload.Content,
 		CreatedAt:    time.Now(),
 		Participants: payload.Participants,
 	}
 
-	if err := h.svc.BroadcastMessage(msg); err != nil {
+	// Clients send the session id of their own connection so the echo to
+	// the sender's devices skips the one that already shows the message
+	accepted, duplicate, err := h.svc.BroadcastMessage(r.Context(), msg, r.Header.Get("X-Session-ID"))
+	switch {
+	case storageUnavailable(w, err):
+		return
+	case errors.Is(err, service.ErrOverloaded), errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		w.Header().Set("Retry-After", overloadRetryAfter)
+		http.Error(w, "server busy, retry later", http.StatusServiceUnavailable)
+		return
+	case err != nil:
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
+	// When messages are stored before they are broadcast the response is
+	// the stored message; a retried send gets the one stored the first time
+	if h.svc.DeliveryMode() == service.PersistThenBroadcast {
+		w.Header().Set("Content-Type", "application/json")
+		if duplicate {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		json.NewEncoder(w).Encode(accepted)
+		return
+	}
+
+	// A retried send gets the id of the message accepted the first time, so
+	// clients can retry after a timeout without checking for duplicates
+	status := "message queued"
+	if duplicate {
+		status = "duplicate"
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(map[string]string{"status": "message queued"})
+	json.NewEncoder(w).Encode(sendMessageResponse{
+		Status:      status,
+		ID:          accepted.ID,
+		ClientMsgID: accepted.ClientMsgID,
+		Seq:         accepted.Seq,
+		CreatedAt:   accepted.CreatedAt,
+	})
+}
+
+// overloadRetryAfter is the Retry-After, in seconds, of sends turned away
+// because the pipeline is saturated
+const overloadRetryAfter = "1"
+
+// storageRetryAfter is the Retry-After, in seconds, of requests failed
+// because the repository's circuit breaker is open
+const storageRetryAfter = "5"
+
+// storageUnavailable answers 503 if err says the database is known to be
+// down, so clients back off instead of waiting for timeouts
+func storageUnavailable(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, repository.ErrCircuitOpen) {
+		return false
+	}
+	w.Header().Set("Retry-After", storageRetryAfter)
+	http.Error(w, "storage unavailable, retry later", http.StatusServiceUnavailable)
+	return true
+}
+
+// maxClientMsgIDLength bounds the ids clients choose for their sends
+const maxClientMsgIDLength = 64
+
+type sendMessageResponse struct {
+	Status      string    `json:"status"`
+	ID          string    `json:"id"`
+	ClientMsgID string    `json:"client_msg_id,omitempty"`
+	Seq         uint64    `json:"seq"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
 func (h *Handler) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
@@ -143,7 +279,64 @@ func (h *Handler) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	messages, err := h.svc.GetMessagesForChannelWithPagination(participants, userID, page, size)
+	messages, err := h.svc.GetMessagesForChannelWithPagination(r.Context(), participants, userID, page, size)
+	if storageUnavailable(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(messages)
+}
+
+// maxGapFill caps the messages returned by one gap fill; clients with a
+// larger gap continue from the last sequence number they got
+const maxGapFill = 100
+
+// HandleGetMessageRange returns the messages of a channel whose sequence
+// numbers lie in [from_seq, to_seq], oldest first, so clients that noticed
+// a gap in the sequence numbers they received can fetch what they missed
+func (h *Handler) HandleGetMessageRange(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	participantsStr := r.URL.Query().Get("participants")
+	if participantsStr == "" {
+		http.Error(w, "participants query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	participants := strings.Split(participantsStr, ",")
+	for i, p := range participants {
+		participants[i] = strings.TrimSpace(p)
+	}
+
+	fromSeq, err := strconv.ParseUint(r.URL.Query().Get("from_seq"), 10, 64)
+	if err != nil || fromSeq == 0 {
+		http.Error(w, "from_seq must be a positive sequence number", http.StatusBadRequest)
+		return
+	}
+	toSeq, err := strconv.ParseUint(r.URL.Query().Get("to_seq"), 10, 64)
+	if err != nil || toSeq < fromSeq {
+		http.Error(w, "to_seq must be a sequence number not below from_seq", http.StatusBadRequest)
+		return
+	}
+
+	messages, err := h.svc.GetMessagesForChannelBySeq(r.Context(), participants, userID, fromSeq, toSeq, maxGapFill)
+	if storageUnavailable(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
@@ -177,3 +370,44 @@ func (h *Handler) HandleGetUserConnections(w http.ResponseWriter, r *http.Reques
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(counts)
 }
+
+// HandleGetQueueStats reports the depth of the DB and hub queues and how
+// many sends they turned away
+func (h *Handler) HandleGetQueueStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.svc.QueueStats())
+}
+
+// HandleGetStorageStats reports the state of the repository's circuit
+// breaker
+func (h *Handler) HandleGetStorageStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, ok := h.svc.StorageStats()
+	if !ok {
+		http.Error(w, "circuit breaker disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// HandleGetRTTStats reports the ping round trips of all WebSocket
+// connections as a cumulative histogram
+func (h *Handler) HandleGetRTTStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.svc.Hub().RTTStats())
+}
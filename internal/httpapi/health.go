@@ -0,0 +1,126 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds every readiness check, so a hanging dependency
+// makes /readyz fail rather than hang
+const readinessTimeout = 2 * time.Second
+
+// readyQueueFill is how full the DB queue may get before the instance
+// reports itself not ready, so load balancers send sends elsewhere before
+// they are rejected with 503
+const readyQueueFill = 0.9
+
+// ReadinessCheck reports whether a dependency of the service is usable
+type ReadinessCheck func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check ReadinessCheck
+}
+
+// componentStatus is the outcome of one readiness check
+type componentStatus struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+type readinessResponse struct {
+	Status     string                     `json:"status"`
+	Components map[string]componentStatus `json:"components,omitempty"`
+}
+
+// AddReadinessCheck adds a dependency to /readyz, e.g. a store configured
+// outside the service. It must be called before the handler serves.
+func (h *Handler) AddReadinessCheck(name string, check ReadinessCheck) {
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// defaultChecks are the dependencies every instance has: MongoDB, the DB
+// write queue and the hub's broadcast workers
+func (h *Handler) defaultChecks() []namedCheck {
+	return []namedCheck{
+		{"mongo", h.svc.PingStorage},
+		{"db_queue", h.checkDBQueue},
+		{"hub", h.svc.Hub().Ping},
+	}
+}
+
+func (h *Handler) checkDBQueue(context.Context) error {
+	stats := h.svc.QueueStats()
+	if stats.DBQueueCapacity > 0 && float64(stats.DBQueueDepth) >= readyQueueFill*float64(stats.DBQueueCapacity) {
+		return fmt.Errorf("db queue holds %d of %d messages", stats.DBQueueDepth, stats.DBQueueCapacity)
+	}
+	return nil
+}
+
+// Livez reports that the process is up and serving HTTP. It checks no
+// dependencies, so an orchestrator doesn't restart instances because the
+// database is down.
+func (h *Handler) Livez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// Readyz runs every readiness check concurrently and answers 503 unless all
+// of them pass. It is public for probes, so the body only carries the
+// overall status; ReadinessDetails reports the components.
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	resp := h.readiness(r.Context())
+	writeReadiness(w, readinessResponse{Status: resp.Status})
+}
+
+// ReadinessDetails runs the same checks as Readyz and reports each
+// component with the time its check took and its error, which may name
+// internal hosts, so it is for admins only
+func (h *Handler) ReadinessDetails(w http.ResponseWriter, r *http.Request) {
+	writeReadiness(w, h.readiness(r.Context()))
+}
+
+func (h *Handler) readiness(ctx context.Context) readinessResponse {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	resp := readinessResponse{Status: "ready", Components: make(map[string]componentStatus, len(h.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(ctx)
+			status := componentStatus{Status: "ok", LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				status.Status = "fail"
+				status.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			resp.Components[c.name] = status
+			if err != nil {
+				resp.Status = "not_ready"
+			}
+		}()
+	}
+	wg.Wait()
+	return resp
+}
+
+func writeReadiness(w http.ResponseWriter, resp readinessResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
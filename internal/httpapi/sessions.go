@@ -0,0 +1,99 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"chat-microservice/internal/middleware"
+	"chat-microservice/internal/ws"
+)
+
+const (
+	maxDeviceIDLength  = 64
+	maxUserAgentLength = 256
+)
+
+// sessionFromRequest reads the session metadata a client sends at handshake:
+// an optional device id from the device_id query parameter (browsers can't
+// set headers on WebSockets) or the X-Device-ID header, and the user agent
+func sessionFromRequest(r *http.Request, transport string) (ws.Session, error) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		deviceID = r.Header.Get("X-Device-ID")
+	}
+	if len(deviceID) > maxDeviceIDLength {
+		return ws.Session{}, fmt.Errorf("device id must be at most %d characters", maxDeviceIDLength)
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	return ws.Session{DeviceID: deviceID, UserAgent: userAgent, Transport: transport}, nil
+}
+
+// resumedSessionID reads the session id an SSE or polling client got on an
+// earlier request, from the session_id query parameter or the X-Session-ID
+// header, so a reconnect or the next poll stays the same session. Empty
+// means a new one is assigned.
+func resumedSessionID(r *http.Request) (string, error) {
+	id := r.URL.Query().Get("session_id")
+	if id == "" {
+		id = r.Header.Get("X-Session-ID")
+	}
+	if id != "" && !ws.ValidSessionID(id) {
+		return "", fmt.Errorf("invalid session id")
+	}
+	return id, nil
+}
+
+type sessionResponse struct {
+	ws.Session
+	PingIntervalSec int      `json:"ping_interval_sec,omitempty"`
+	RTTMs           *float64 `json:"rtt_ms,omitempty"`
+}
+
+// HandleListSessions lists the caller's active connections across devices
+// and transports
+func (h *Handler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions := []sessionResponse{}
+	for _, sub := range h.svc.Hub().Subscribers(userID) {
+		s := sessionResponse{Session: sub.Session()}
+		if client, ok := sub.(*ws.Client); ok {
+			s.PingIntervalSec = int(client.Keepalive().PingPeriod / time.Second)
+			if stats := client.Stats(); stats.PongsReceived > 0 {
+				rtt := float64(stats.SmoothedRTT) / float64(time.Millisecond)
+				s.RTTMs = &rtt
+			}
+		}
+		sessions = append(sessions, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"sessions": sessions})
+}
+
+// HandleDeleteSession disconnects one of the caller's sessions, e.g. a
+// device they lost
+func (h *Handler) HandleDeleteSession(w http.ResponseWriter, r *http.Request) {
+	userID, ok := middleware.GetUserID(r)
+	if !ok {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !h.svc.Hub().Terminate(userID, r.PathValue("id")) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
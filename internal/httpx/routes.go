@@ -0,0 +1,30 @@
+// Package httpx holds the pieces shared by the middlewares that observe
+// every request, metrics and tracing.
+package httpx
+
+import "net/http"
+
+// OtherRoute labels requests that match none of the routes
+const OtherRoute = "other"
+
+// Routes labels requests with the ServeMux pattern they are served under,
+// so paths with ids don't each get a label of their own
+type Routes struct {
+	lookup *http.ServeMux
+}
+
+func NewRoutes(patterns []string) *Routes {
+	lookup := http.NewServeMux()
+	for _, pattern := range patterns {
+		lookup.Handle(pattern, http.NotFoundHandler())
+	}
+	return &Routes{lookup: lookup}
+}
+
+// Match returns the pattern r is served under, or OtherRoute
+func (rt *Routes) Match(r *http.Request) string {
+	if _, pattern := rt.lookup.Handler(r); pattern != "" {
+		return pattern
+	}
+	return OtherRoute
+}
@@ -0,0 +1,237 @@
+// Package metrics collects the service's instrumentation and serves it in
+// the Prometheus exposition format. A nil *Metrics records nothing, so
+// components take one optionally.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"chat-microservice/internal/httpx"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chat"
+
+// Reasons accepted messages are dropped without being stored
+const (
+	DropSaveFailed = "save_failed" // every attempt failed or the retry policy gave up
+	DropPermanent  = "permanent"   // the database rejected the message for good
+	DropDuplicate  = "duplicate"   // a retried send whose original was stored first, without a placeholder
+	DropShutdown   = "shutdown"    // still queued when the service stopped
+)
+
+// Save operations timed by ObserveSave
+const (
+	OpSave      = "save"
+	OpSaveBatch = "save_batch"
+)
+
+// Metrics holds the collectors of one service instance and the registry
+// they are served from
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	messagesAccepted  prometheus.Counter
+	messagesBroadcast prometheus.Counter
+	messagesPersisted prometheus.Counter
+	messagesDropped   *prometheus.CounterVec
+
+	saveDuration *prometheus.HistogramVec
+	saveRetries  prometheus.Counter
+
+	rateLimited *prometheus.CounterVec
+}
+
+// New creates the collectors, along with the Go runtime and process ones,
+// on a registry of their own
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time to serve HTTP requests by route and method; streaming routes count their whole connection.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		messagesAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_accepted_total",
+			Help:      "Messages accepted for delivery, not counting duplicates.",
+		}),
+		messagesBroadcast: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_broadcast_total",
+			Help:      "Accepted messages queued in every hub shard of their participants.",
+		}),
+		messagesPersisted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_persisted_total",
+			Help:      "Messages stored in the database, including those found stored already.",
+		}),
+		messagesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "messages_dropped_total",
+			Help:      "Accepted messages given up on without being stored, by reason.",
+		}, []string{"reason"}),
+
+		saveDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "db_save_duration_seconds",
+			Help:      "Latency of database writes by operation, failed ones included.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"op"}),
+		saveRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "db_save_retries_total",
+			Help:      "Database writes repeated after a transient failure.",
+		}),
+
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rate_limit_rejections_total",
+			Help:      "Requests answered 429 by the rate limiters, by scope (user or ip), and WebSocket frames dropped by the frame limits (ws_frame).",
+		}, []string{"scope"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpDuration,
+		m.messagesAccepted, m.messagesBroadcast, m.messagesPersisted, m.messagesDropped,
+		m.saveDuration, m.saveRetries,
+		m.rateLimited,
+	)
+	return m
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Gauge registers a gauge whose value is read from fn at every scrape, for
+// levels a component already tracks such as queue depths
+func (m *Metrics) Gauge(name, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace, Name: name, Help: help,
+	}, fn))
+}
+
+// Counter registers a counter whose value is read from fn at every scrape,
+// for totals a component already keeps
+func (m *Metrics) Counter(name, help string, fn func() float64) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace, Name: name, Help: help,
+	}, fn))
+}
+
+// GaugeVec registers a gauge with one label whose values are read from fn
+// at every scrape
+func (m *Metrics) GaugeVec(name, help, label string, fn func() map[string]float64) {
+	if m == nil {
+		return
+	}
+	m.registry.MustRegister(&gaugeVecFunc{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, []string{label}, nil),
+		fn:   fn,
+	})
+}
+
+type gaugeVecFunc struct {
+	desc *prometheus.Desc
+	fn   func() map[string]float64
+}
+
+func (g *gaugeVecFunc) Describe(ch chan<- *prometheus.Desc) { ch <- g.desc }
+
+func (g *gaugeVecFunc) Collect(ch chan<- prometheus.Metric) {
+	for label, v := range g.fn() {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, v, label)
+	}
+}
+
+func (m *Metrics) MessageAccepted() {
+	if m != nil {
+		m.messagesAccepted.Inc()
+	}
+}
+
+func (m *Metrics) MessageBroadcast() {
+	if m != nil {
+		m.messagesBroadcast.Inc()
+	}
+}
+
+func (m *Metrics) MessagesPersisted(n int) {
+	if m != nil && n > 0 {
+		m.messagesPersisted.Add(float64(n))
+	}
+}
+
+func (m *Metrics) MessagesDropped(reason string, n int) {
+	if m != nil && n > 0 {
+		m.messagesDropped.WithLabelValues(reason).Add(float64(n))
+	}
+}
+
+// ObserveSave records how long a database write took
+func (m *Metrics) ObserveSave(op string, d time.Duration) {
+	if m != nil {
+		m.saveDuration.WithLabelValues(op).Observe(d.Seconds())
+	}
+}
+
+func (m *Metrics) SaveRetried() {
+	if m != nil {
+		m.saveRetries.Inc()
+	}
+}
+
+// RateLimited counts a request or frame rejected by the limiter of the given
+// scope
+func (m *Metrics) RateLimited(scope string) {
+	if m != nil {
+		m.rateLimited.WithLabelValues(scope).Inc()
+	}
+}
+
+// Middleware counts and times every request. Requests are labeled with the
+// route they match, as a ServeMux pattern, so paths with ids don't each get
+// their own series; others are labeled "other".
+func (m *Metrics) Middleware(routes []string, next http.Handler) http.Handler {
+	if m == nil {
+		return next
+	}
+	lookup := httpx.NewRoutes(routes)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := lookup.Match(r)
+		start := time.Now()
+		rec := httpx.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+
+		m.httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.Status())).Inc()
+		m.httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,205 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, DELETE, OPTIONS"
+	corsAllowedHeaders = "Authorization, Content-Type, X-Device-ID, X-Request-ID, X-Session-ID"
+	corsExposedHeaders = "Retry-After, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-ID"
+	corsMaxAge         = 600
+)
+
+// originPattern is a parsed entry of the allow-list. An empty scheme matches
+// any scheme; a missing port is the default port of the scheme, so
+// https://example.com doesn't allow https://example.com:8443. A wildcard
+// pattern such as https://*.example.com matches every subdomain of
+// example.com but not example.com itself.
+type originPattern struct {
+	scheme   string
+	host     string
+	port     string
+	wildcard bool
+}
+
+type CORS struct {
+	patterns []originPattern
+	allowAll bool
+}
+
+// NewCORS builds an origin policy from a list of allowed origins. Entries may
+// be exact origins (https://chat.example.com), wildcard subdomains
+// (https://*.example.com) or "*" to allow any origin. An entry that isn't an
+// origin, e.g. one with a path, is an error rather than a pattern that never
+// matches.
+func NewCORS(allowedOrigins []string) (*CORS, error) {
+	c := &CORS{}
+	for _, origin := range allowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			c.allowAll = true
+			continue
+		}
+		p, err := parseOriginPattern(origin)
+		if err != nil {
+			return nil, err
+		}
+		c.patterns = append(c.patterns, p)
+	}
+	return c, nil
+}
+
+// parseOriginPattern parses an entry the way AllowOrigin parses an Origin
+// header, so both compare the same form of the host: lower case and
+// without the brackets of an IPv6 address
+func parseOriginPattern(origin string) (originPattern, error) {
+	raw := origin
+	if !strings.Contains(origin, "://") {
+		origin = "//" + origin
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return originPattern{}, fmt.Errorf("invalid origin %q: %w", raw, err)
+	}
+	if u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return originPattern{}, fmt.Errorf("invalid origin %q: expected scheme://host[:port]", raw)
+	}
+
+	p := originPattern{
+		scheme: strings.ToLower(u.Scheme),
+		host:   strings.ToLower(u.Hostname()),
+		port:   u.Port(),
+	}
+	if rest, ok := strings.CutPrefix(p.host, "*."); ok {
+		p.wildcard = true
+		p.host = "." + rest
+	}
+	if p.host == "." || strings.Contains(p.host, "*") {
+		return originPattern{}, fmt.Errorf("invalid origin %q: a wildcard must be a leading *. before a domain", raw)
+	}
+	if p.port == "" {
+		p.port = defaultPort(p.scheme)
+	}
+	return p, nil
+}
+
+func (p originPattern) matches(scheme, host, port string) bool {
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	// A pattern without scheme or port allows the default port of the
+	// origin's scheme
+	want := p.port
+	if want == "" {
+		want = defaultPort(scheme)
+	}
+	if want != port {
+		return false
+	}
+	if p.wildcard {
+		return strings.HasSuffix(host, p.host) && len(host) > len(p.host)
+	}
+	return host == p.host
+}
+
+// defaultPort is the port an origin of scheme has when it names none
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "https", "wss":
+		return "443"
+	case "http", "ws":
+		return "80"
+	}
+	return ""
+}
+
+// AllowOrigin reports whether the value of an Origin header is on the allow-list
+func (c *CORS) AllowOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if c.allowAll {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPort(scheme)
+	}
+
+	for _, p := range c.patterns {
+		if p.matches(scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin is meant for websocket.Upgrader. Requests without an Origin
+// header come from non-browser clients and are accepted, as are same-origin
+// requests; cross-origin handshakes must match the allow-list to prevent
+// cross-site WebSocket hijacking.
+func (c *CORS) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return c.AllowOrigin(origin)
+}
+
+// Middleware adds CORS headers for allowed origins and answers preflight
+// requests itself, so it has to be mounted in front of the auth middleware.
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		allowed := c.AllowOrigin(origin)
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if preflight {
+			if !allowed {
+				http.Error(w, "origin not allowed", http.StatusForbidden)
+				return
+			}
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
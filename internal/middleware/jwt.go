@@ -6,17 +6,23 @@ import (
 	"net/http"
 	"strings"
 
+	"chat-microservice/internal/reqctx"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
 const (
-	UserContextKey contextKey = "userID"
+	UserContextKey   contextKey = "userID"
+	ScopesContextKey contextKey = "scopes"
 )
 
 type CustomClaims struct {
-	ID string `json:"id"`
+	ID    string   `json:"id"`
+	Roles []string `json:"roles,omitempty"`
+	// Scope is a space-delimited list of scopes, as in OAuth 2.0 access tokens
+	Scope string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -59,6 +65,8 @@ func (am *AuthMiddleware) Verify(next http.Handler) http.Handler {
 		}
 
 		ctx := context.WithValue(r.Context(), UserContextKey, claims.ID)
+		ctx = context.WithValue(ctx, ScopesContextKey, claims.Scopes())
+		ctx = reqctx.WithUserID(ctx, claims.ID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -1,40 +1,122 @@
 package middleware
 
 import (
+	"context"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
+
+	"chat-microservice/internal/metrics"
 
 	"golang.org/x/time/rate"
 )
 
+// Policy is a token bucket refilled at Rate tokens per second up to Burst
+type Policy struct {
+	Rate  rate.Limit
+	Burst int
+}
+
+// Result describes the state of a bucket after a request was counted against it
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// Backend stores the buckets behind a RateLimiter. Allow counts one request
+// against the bucket identified by key, creating it from the policy if needed.
+type Backend interface {
+	Allow(ctx context.Context, key string, p Policy) (Result, error)
+}
+
 type RateLimiter struct {
-	visitors map[string]*rate.Limiter
-	mu       sync.Mutex
-	rps      rate.Limit
-	burst    int
+	backend    Backend
+	mu         sync.Mutex
+	policy     Policy
+	routes     map[string]Policy
+	trustProxy bool
+
+	metrics *metrics.Metrics
+	scope   string // labels the rejections counted in metrics
 }
 
+// NewRateLimiter creates a process-local limiter whose default policy allows
+// rps requests per second with the given burst
 func NewRateLimiter(rps rate.Limit, burst int) *RateLimiter {
+	return NewRateLimiterWithBackend(NewMemoryBackend(defaultIdleTTL), Policy{Rate: rps, Burst: burst})
+}
+
+// NewRateLimiterWithBackend creates a limiter that keeps its buckets in the
+// given backend, e.g. a RedisBackend shared by every replica
+func NewRateLimiterWithBackend(backend Backend, p Policy) *RateLimiter {
 	return &RateLimiter{
-		visitors: make(map[string]*rate.Limiter),
-		rps:      rps,
-		burst:    burst,
+		backend: backend,
+		policy:  p,
+		routes:  make(map[string]Policy),
 	}
 }
 
-func (rl *RateLimiter) getVisitor(userID string) *rate.Limiter {
+// SetRoutePolicy overrides the default policy for requests to path. Each route
+// with its own policy gets a separate bucket per visitor.
+func (rl *RateLimiter) SetRoutePolicy(path string, p Policy) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
+	rl.routes[path] = p
+}
 
-	limiter, exists := rl.visitors[userID]
-	if !exists {
-		limiter = rate.NewLimiter(rl.rps, rl.burst)
-		rl.visitors[userID] = limiter
+// SetTrustProxyHeaders makes IP-based limiting use X-Forwarded-For and
+// X-Real-IP. Only enable it behind a proxy that overwrites those headers.
+func (rl *RateLimiter) SetTrustProxyHeaders(trust bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.trustProxy = trust
+}
+
+// SetMetrics counts the requests the limiter rejects under the given scope,
+// e.g. "user" or "ip"
+func (rl *RateLimiter) SetMetrics(m *metrics.Metrics, scope string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.metrics = m
+	rl.scope = scope
+}
+
+// Stop releases background resources held by the backend
+func (rl *RateLimiter) Stop() {
+	if s, ok := rl.backend.(interface{ Stop() }); ok {
+		s.Stop()
 	}
+}
 
-	return limiter
+// policyFor returns the policy for a path and the bucket namespace to use
+func (rl *RateLimiter) policyFor(path string) (Policy, string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if p, ok := rl.routes[path]; ok {
+		return p, path
+	}
+	return rl.policy, "*"
+}
+
+// refillTime returns how long the bucket needs to regain the given tokens
+func refillTime(tokens float64, r rate.Limit) time.Duration {
+	if tokens <= 0 || r <= 0 {
+		return 0
+	}
+	return time.Duration(tokens / float64(r) * float64(time.Second))
 }
 
+// Middleware limits authenticated requests per user and must be mounted
+// behind AuthMiddleware.Verify
 func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		userID, ok := r.Context().Value(UserContextKey).(string)
@@ -43,12 +125,78 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 			return
 		}
 
-		limiter := rl.getVisitor(userID)
-		if !limiter.Allow() {
-			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-			return
-		}
+		rl.serve(w, r, next, "user:"+userID)
+	})
+}
 
-		next.ServeHTTP(w, r)
+// IPMiddleware limits requests per client IP and is meant for paths that are
+// reachable before authentication, such as the WebSocket handshake
+func (rl *RateLimiter) IPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl.mu.Lock()
+		trustProxy := rl.trustProxy
+		rl.mu.Unlock()
+
+		rl.serve(w, r, next, "ip:"+ClientIP(r, trustProxy))
 	})
 }
+
+func (rl *RateLimiter) serve(w http.ResponseWriter, r *http.Request, next http.Handler, visitorKey string) {
+	policy, namespace := rl.policyFor(r.URL.Path)
+	res, err := rl.backend.Allow(r.Context(), namespace+"|"+visitorKey, policy)
+	if err != nil {
+		// Fail open: an unavailable shared store must not take the API down
+		log.Printf("rate limiter backend error: %v", err)
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	writeRateLimitHeaders(w, res)
+	if !res.Allowed {
+		rl.mu.Lock()
+		m, scope := rl.metrics, rl.scope
+		rl.mu.Unlock()
+		m.RateLimited(scope)
+
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	next.ServeHTTP(w, r)
+}
+
+func writeRateLimitHeaders(w http.ResponseWriter, res Result) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.ResetAfter)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 && d > 0 {
+		return 1
+	}
+	return s
+}
+
+// ClientIP returns the IP address of the client that sent the request
+func ClientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+		if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const defaultIdleTTL = 10 * time.Minute
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// MemoryBackend keeps token buckets in process memory. Limits are enforced
+// per replica, so it only suits single-instance deployments and tests.
+type MemoryBackend struct {
+	visitors map[string]*visitor
+	mu       sync.Mutex
+	idleTTL  time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewMemoryBackend creates a backend whose visitors are evicted by a
+// background janitor once idle for longer than idleTTL, until Stop is called
+func NewMemoryBackend(idleTTL time.Duration) *MemoryBackend {
+	if idleTTL <= 0 {
+		idleTTL = defaultIdleTTL
+	}
+
+	b := &MemoryBackend{
+		visitors: make(map[string]*visitor),
+		idleTTL:  idleTTL,
+		stop:     make(chan struct{}),
+	}
+
+	go b.janitor()
+
+	return b
+}
+
+func (b *MemoryBackend) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+}
+
+func (b *MemoryBackend) janitor() {
+	ticker := time.NewTicker(b.idleTTL / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			b.evictIdle(now)
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+func (b *MemoryBackend) evictIdle(now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for key, v := range b.visitors {
+		if now.Sub(v.lastSeen) > b.idleTTL {
+			delete(b.visitors, key)
+		}
+	}
+}
+
+func (b *MemoryBackend) Allow(_ context.Context, key string, p Policy) (Result, error) {
+	now := time.Now()
+
+	b.mu.Lock()
+	v, exists := b.visitors[key]
+	if !exists {
+		v = &visitor{limiter: rate.NewLimiter(p.Rate, p.Burst)}
+		b.visitors[key] = v
+	}
+	v.lastSeen = now
+	b.mu.Unlock()
+
+	allowed := v.limiter.AllowN(now, 1)
+	tokens := v.limiter.TokensAt(now)
+
+	res := Result{
+		Allowed:    allowed,
+		Limit:      p.Burst,
+		Remaining:  int(math.Max(0, math.Floor(tokens))),
+		ResetAfter: refillTime(float64(p.Burst)-tokens, p.Rate),
+	}
+	if !allowed {
+		res.RetryAfter = refillTime(1-tokens, p.Rate)
+	}
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// gcraScript implements the generic cell rate algorithm. The bucket is a
+// single key holding the theoretical arrival time (TAT) of the next request,
+// so checking and updating it in one script is atomic across replicas. Time
+// comes from the Redis server to avoid clock skew between replicas.
+//
+// KEYS[1]  bucket key
+// ARGV[1]  burst
+// ARGV[2]  rate in tokens per second
+//
+// Returns {allowed, remaining, retry_after, reset_after} with durations in
+// seconds as strings, since Lua numbers are truncated to integers on return.
+var gcraScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local emission_interval = 1 / rate
+local burst_offset = emission_interval * burst
+
+local t = redis.call("TIME")
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+
+local tat = tonumber(redis.call("GET", KEYS[1]))
+if not tat or tat < now then
+  tat = now
+end
+
+local new_tat = tat + emission_interval
+local diff = now - (new_tat - burst_offset)
+local remaining = math.floor(diff / emission_interval + 1e-9)
+
+if remaining < 0 then
+  return {0, 0, tostring(-diff), tostring(tat - now)}
+end
+
+local reset_after = new_tat - now
+redis.call("SET", KEYS[1], tostring(new_tat), "PX", math.ceil(reset_after * 1000))
+return {1, remaining, "0", tostring(reset_after)}
+`)
+
+// RedisBackend keeps buckets in Redis (or any server speaking its protocol
+// with Lua scripting), so every replica enforces the same quota
+type RedisBackend struct {
+	client redis.Scripter
+	prefix string
+}
+
+func NewRedisBackend(client redis.Scripter, prefix string) *RedisBackend {
+	if prefix == "" {
+		prefix = "ratelimit:"
+	}
+	return &RedisBackend{client: client, prefix: prefix}
+}
+
+func (b *RedisBackend) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	if p.Rate <= 0 || p.Burst <= 0 {
+		return Result{}, fmt.Errorf("invalid rate limit policy %+v", p)
+	}
+
+	rate := strconv.FormatFloat(float64(p.Rate), 'f', -1, 64)
+	values, err := gcraScript.Run(ctx, b.client, []string{b.prefix + key}, p.Burst, rate).Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	if len(values) != 4 {
+		return Result{}, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	retryAfter, err := parseSeconds(values[2])
+	if err != nil {
+		return Result{}, err
+	}
+	resetAfter, err := parseSeconds(values[3])
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Allowed:    allowed == 1,
+		Limit:      p.Burst,
+		Remaining:  int(remaining),
+		RetryAfter: retryAfter,
+		ResetAfter: resetAfter,
+	}, nil
+}
+
+func parseSeconds(v interface{}) (time.Duration, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("unexpected duration %v", v)
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(math.Max(0, f) * float64(time.Second)), nil
+}
@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+
+	"chat-microservice/internal/reqctx"
+)
+
+// maxRequestIDLength bounds the request ids accepted from clients
+const maxRequestIDLength = 64
+
+// RequestID tags every request with an id, taken from the X-Request-ID
+// header when the client or a proxy sent a usable one and generated
+// otherwise. The id is echoed in the response and travels in the request
+// context down to the database queries it causes.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = reqctx.NewRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(reqctx.WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID accepts short ids of printable ASCII without spaces, so
+// they can't break log lines
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"chat-microservice/pkg/models"
+)
+
+// ErrCircuitOpen is returned instead of calling the database while the
+// circuit breaker is open. Nothing was read or written.
+var ErrCircuitOpen = errors.New("storage unavailable: circuit open")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed passes every call through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every call with ErrCircuitOpen
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through; its outcome closes or
+	// reopens the circuit
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *BreakerState) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "closed":
+		*s = BreakerClosed
+	case "open":
+		*s = BreakerOpen
+	case "half-open":
+		*s = BreakerHalfOpen
+	default:
+		return fmt.Errorf("unknown circuit breaker state %q", text)
+	}
+	return nil
+}
+
+// BreakerConfig controls when a CircuitBreaker opens and how long it stays
+// open
+type BreakerConfig struct {
+	// FailureThreshold consecutive failed calls open the circuit
+	FailureThreshold int
+	// OpenTimeout is how long an open circuit fails calls before it lets a
+	// probe through
+	OpenTimeout time.Duration
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: 5,
+		OpenTimeout:      10 * time.Second,
+	}
+}
+
+// BreakerStats describes the state of a CircuitBreaker
+type BreakerStats struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	// Trips counts how often the circuit opened, Rejected the calls it
+	// failed without trying
+	Trips    uint64 `json:"trips"`
+	Rejected uint64 `json:"rejected"`
+	// OpenedAt is when the circuit last opened, unset while closed
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// CircuitBreaker wraps a Repository and stops calling it after
+// FailureThreshold consecutive failures, so an unreachable database costs
+// callers nothing instead of a timeout each. After OpenTimeout one call is
+// let through as a probe: if it succeeds the circuit closes, otherwise it
+// stays open for another OpenTimeout.
+//
+// Only errors that Retryable accepts count as failures; duplicates,
+// validation failures and calls canceled by their caller say nothing about
+// the database.
+// List reports no errors and always passes through.
+type CircuitBreaker struct {
+	repo Repository
+	cfg  BreakerConfig
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	trips    uint64
+	rejected uint64
+}
+
+func NewCircuitBreaker(repo Repository, cfg BreakerConfig) *CircuitBreaker {
+	if cfg.FailureThreshold <= 0 {
+		cfg.FailureThreshold = 1
+	}
+	return &CircuitBreaker{repo: repo, cfg: cfg}
+}
+
+// Stats reports the state of the circuit
+func (b *CircuitBreaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := BreakerStats{
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		Trips:               b.trips,
+		Rejected:            b.rejected,
+	}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
+
+// allow decides whether a call may go through and whether it is the probe
+// of a half-open circuit
+func (b *CircuitBreaker) allow() (probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.OpenTimeout {
+			b.rejected++
+			return false, ErrCircuitOpen
+		}
+		log.Printf("circuit breaker half-open, probing storage")
+		b.state = BreakerHalfOpen
+		b.probing = false
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			b.rejected++
+			return false, ErrCircuitOpen
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// done records the outcome of a call that went through
+func (b *CircuitBreaker) done(probe bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+
+	switch {
+	case err != nil && !Retryable(err):
+		// Says nothing about the database; a canceled probe just makes room
+		// for the next one
+	case err != nil:
+		b.failures++
+		if probe || (b.state == BreakerClosed && b.failures >= b.cfg.FailureThreshold) {
+			b.state = BreakerOpen
+			b.openedAt = time.Now()
+			b.trips++
+			log.Printf("circuit breaker open after %d consecutive failures: %v", b.failures, err)
+		}
+	default:
+		b.failures = 0
+		if probe {
+			b.state = BreakerClosed
+			log.Printf("circuit breaker closed, storage recovered")
+		}
+	}
+}
+
+func guard[T any](b *CircuitBreaker, call func() (T, error)) (T, error) {
+	probe, err := b.allow()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	v, err := call()
+	b.done(probe, err)
+	return v, err
+}
+
+func (b *CircuitBreaker) Save(ctx context.Context, msg *models.Message) error {
+	_, err := guard(b, func() (struct{}, error) {
+		return struct{}{}, b.repo.Save(ctx, msg)
+	})
+	return err
+}
+
+func (b *CircuitBreaker) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	_, err := guard(b, func() (struct{}, error) {
+		return struct{}{}, b.repo.SaveBatch(ctx, msgs)
+	})
+	return err
+}
+
+// Ping checks the wrapped repository's connection whatever the state of the
+// circuit, so readiness checks see the database recover before a probe
+// closes the circuit. Its outcome doesn't change the state.
+func (b *CircuitBreaker) Ping(ctx context.Context) error {
+	if p, ok := b.repo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (b *CircuitBreaker) List(ctx context.Context) []*models.Message {
+	return b.repo.List(ctx)
+}
+
+func (b *CircuitBreaker) GetMessagesByParticipants(ctx context.Context, participants []string) ([]*models.Message, error) {
+	return guard(b, func() ([]*models.Message, error) {
+		return b.repo.GetMessagesByParticipants(ctx, participants)
+	})
+}
+
+func (b *CircuitBreaker) GetMessagesByParticipantsWithPagination(ctx context.Context, participants []string, page int, size int) ([]*models.Message, error) {
+	return guard(b, func() ([]*models.Message, error) {
+		return b.repo.GetMessagesByParticipantsWithPagination(ctx, participants, page, size)
+	})
+}
+
+func (b *CircuitBreaker) NextSeq(ctx context.Context, channelID string) (uint64, error) {
+	return guard(b, func() (uint64, error) {
+		return b.repo.NextSeq(ctx, channelID)
+	})
+}
+
+func (b *CircuitBreaker) GetMessageByClientMsgID(ctx context.Context, sender, clientMsgID string) (*models.Message, error) {
+	return guard(b, func() (*models.Message, error) {
+		return b.repo.GetMessageByClientMsgID(ctx, sender, clientMsgID)
+	})
+}
+
+func (b *CircuitBreaker) GetMessagesBySeqRange(ctx context.Context, participants []string, fromSeq, toSeq uint64, limit int) ([]*models.Message, error) {
+	return guard(b, func() ([]*models.Message, error) {
+		return b.repo.GetMessagesBySeqRange(ctx, participants, fromSeq, toSeq, limit)
+	})
+}
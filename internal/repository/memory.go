@@ -2,29 +2,166 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"chat-microservice/internal/reqctx"
 	"chat-microservice/pkg/models"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
+// ErrDuplicateMessage is returned by Save for a message whose id is already
+// stored, i.e. an earlier attempt to store the same message succeeded
+var ErrDuplicateMessage = errors.New("message already stored")
+
+// ErrDuplicateClientMsgID is returned by Save for a message whose sender
+// already stored another message with the same client_msg_id: the message
+// is a retried send, and GetMessageByClientMsgID returns the original
+var ErrDuplicateClientMsgID = errors.New("client_msg_id already used by a stored message")
+
+// ErrMessageNotFound is returned by lookups of a single message that isn't
+// stored
+var ErrMessageNotFound = errors.New("message not found")
+
+// BatchError reports the messages of a SaveBatch that weren't stored, by
+// their index in the batch. The others were stored.
+type BatchError struct {
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	first := -1
+	for i := range e.Errors {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	if first < 0 {
+		return "batch not stored"
+	}
+	return fmt.Sprintf("%d messages of the batch not stored, message %d: %v", len(e.Errors), first, e.Errors[first])
+}
+
+// Repository stores messages. Every method gives up once its context is
+// done, so a client that disconnects cancels the queries it caused.
 type Repository interface {
-	Save(*models.Message) error
-	List() []*models.Message
-	GetMessagesByParticipants(participants []string) ([]*models.Message, error)
-	GetMessagesByParticipantsWithPagination(participants []string, page int, size int) ([]*models.Message, error)
+	Save(ctx context.Context, msg *models.Message) error
+	// SaveBatch stores several messages at once. If only some of them fail
+	// it returns a *BatchError; any other error means none may be stored.
+	SaveBatch(ctx context.Context, msgs []*models.Message) error
+	List(ctx context.Context) []*models.Message
+	// GetMessagesByParticipants and its paginated variant return a channel's
+	// history, leaving out placeholders (Message.DuplicateOf)
+	GetMessagesByParticipants(ctx context.Context, participants []string) ([]*models.Message, error)
+	GetMessagesByParticipantsWithPagination(ctx context.Context, participants []string, page int, size int) ([]*models.Message, error)
+	// NextSeq reserves the next sequence number of a channel. Numbers start
+	// at 1 and are shared by all instances using the repository.
+	NextSeq(ctx context.Context, channelID string) (uint64, error)
+	// GetMessagesBySeqRange returns up to limit stored messages of a channel
+	// with fromSeq <= seq <= toSeq, in sequence order. Placeholders are
+	// included, so gap fills can tell a number is taken.
+	GetMessagesBySeqRange(ctx context.Context, participants []string, fromSeq, toSeq uint64, limit int) ([]*models.Message, error)
+	// GetMessageByClientMsgID returns the message a sender stored with a
+	// client_msg_id, or ErrMessageNotFound
+	GetMessageByClientMsgID(ctx context.Context, sender, clientMsgID string) (*models.Message, error)
+}
+
+// Pinger is implemented by repositories that can check their connection to
+// the database without reading or writing messages
+type Pinger interface {
+	Ping(ctx context.Context) error
 }
 
 type MongoRepository struct {
 	collection *mongo.Collection
+	// counters holds one document per channel with the last sequence
+	// number handed out
+	counters *mongo.Collection
+
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// MongoOptions tune how the repository talks to MongoDB
+type MongoOptions struct {
+	WriteConcern WriteConcern
+	// ReadTimeout and WriteTimeout bound every query and write, on top of
+	// whatever deadline the caller's context has
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+func DefaultMongoOptions() MongoOptions {
+	return MongoOptions{
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 5 * time.Second,
+	}
+}
+
+// WriteConcern is the acknowledgement MongoDB gives for writes. The zero
+// value keeps the server's default.
+type WriteConcern struct {
+	// W is "majority", a tag set name or the number of members that must
+	// acknowledge a write
+	W string
+	// Journal waits until the write reached the on-disk journal
+	Journal bool
+	// WTimeout bounds how long to wait for W members; zero waits as long
+	// as the operation's deadline allows
+	WTimeout time.Duration
+}
+
+// Validate rejects unacknowledged writes (W "0"). The repository needs to
+// hear back from MongoDB: NextSeq reads the counter it increments, and
+// duplicates are only detected through the errors of inserts.
+func (wc WriteConcern) Validate() error {
+	if wc.W == "0" {
+		return errors.New("unacknowledged write concern w=0 is not supported")
+	}
+	return nil
+}
+
+func (wc WriteConcern) isZero() bool {
+	return wc == WriteConcern{}
+}
+
+func (wc WriteConcern) mongo() *writeconcern.WriteConcern {
+	c := &writeconcern.WriteConcern{WTimeout: wc.WTimeout}
+	if n, err := strconv.Atoi(wc.W); err == nil {
+		c.W = n
+	} else if wc.W != "" {
+		c.W = wc.W
+	}
+	if wc.Journal {
+		journal := true
+		c.Journal = &journal
+	}
+	return c
 }
 
 func NewMongoRepository(mongoURI, database, collection string) (*MongoRepository, error) {
+	return NewMongoRepositoryWithOptions(mongoURI, database, collection, DefaultMongoOptions())
+}
+
+// NewMongoRepositoryWithOptions connects like NewMongoRepository. The write
+// concern applies to messages; sequence counters are written with w:1, since
+// every send waits for its number.
+func NewMongoRepositoryWithOptions(mongoURI, database, collection string, opts MongoOptions) (*MongoRepository, error) {
+	wc := opts.WriteConcern
+	if err := wc.Validate(); err != nil {
+		return nil, err
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
@@ -37,7 +174,11 @@ func NewMongoRepository(mongoURI, database, collection string) (*MongoRepository
 		return nil, err
 	}
 
-	coll := client.Database(database).Collection(collection)
+	collOpts := options.Collection()
+	if !wc.isZero() {
+		collOpts.SetWriteConcern(wc.mongo())
+	}
+	coll := client.Database(database).Collection(collection, collOpts)
 
 	indexModel := mongo.IndexModel{
 		Keys: bson.D{{Key: "participants", Value: 1}},
@@ -47,27 +188,136 @@ func NewMongoRepository(mongoURI, database, collection string) (*MongoRepository
 		log.Printf("warning: failed to create index on participants: %v", err)
 	}
 
-	return &MongoRepository{collection: coll}, nil
+	// Retried sends carry the same client_msg_id; the index keeps a retry
+	// that got past the service's dedup window from being stored twice.
+	// Messages without one are left out of it.
+	clientIDIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "sender", Value: 1}, {Key: "client_msg_id", Value: 1}},
+		Options: options.Index().
+			SetName(clientMsgIDIndex).
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"client_msg_id": bson.M{"$exists": true}}),
+	}
+	if _, err := coll.Indexes().CreateOne(ctx, clientIDIndex); err != nil {
+		log.Printf("warning: failed to create unique index on client_msg_id: %v", err)
+	}
+
+	// Gap fills look up a channel by sequence range
+	seqIndex := mongo.IndexModel{
+		Keys: bson.D{{Key: "participants", Value: 1}, {Key: "seq", Value: 1}},
+	}
+	if _, err := coll.Indexes().CreateOne(ctx, seqIndex); err != nil {
+		log.Printf("warning: failed to create index on seq: %v", err)
+	}
+
+	// A failover can roll back the last increments of a counter, reissuing
+	// their numbers; the sends waiting on NextSeq matter more
+	counters := client.Database(database).Collection(collection+"_counters",
+		options.Collection().SetWriteConcern(writeconcern.W1()))
+
+	return &MongoRepository{
+		collection:   coll,
+		counters:     counters,
+		readTimeout:  opts.ReadTimeout,
+		writeTimeout: opts.WriteTimeout,
+	}, nil
 }
 
 func (m *MongoRepository) Collection() *mongo.Collection {
 	return m.collection
 }
 
-func (m *MongoRepository) Save(msg *models.Message) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// Drop removes the messages and the sequence counters of their channels
+func (m *MongoRepository) Drop(ctx context.Context) error {
+	if err := m.collection.Drop(ctx); err != nil {
+		return err
+	}
+	return m.counters.Drop(ctx)
+}
+
+// Ping checks that the primary is reachable, since that is where writes go
+func (m *MongoRepository) Ping(ctx context.Context) error {
+	ctx, cancel := withTimeout(ctx, m.readTimeout)
+	defer cancel()
+	return m.collection.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+// withTimeout derives the context of one operation. A zero timeout leaves
+// the caller's deadline alone.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// comment tags an operation with the request and user it was issued for, so
+// it can be told apart in the database profiler and slow query log
+func comment(ctx context.Context) string {
+	return reqctx.Describe(ctx)
+}
+
+// clientMsgIDIndex is the unique index on sender and client_msg_id
+const clientMsgIDIndex = "sender_1_client_msg_id_1"
+
+// duplicateKey tells which unique index a duplicate key error of an insert
+// hit: the id, meaning the message is stored already, or the client id,
+// meaning another message of the sender has it. Other errors are returned
+// unchanged.
+func duplicateKey(we mongo.WriteError) error {
+	if !mongo.IsDuplicateKeyError(we) {
+		return we
+	}
+	if _, err := we.Raw.LookupErr("keyPattern", "client_msg_id"); err == nil || strings.Contains(we.Message, clientMsgIDIndex) {
+		return ErrDuplicateClientMsgID
+	}
+	return ErrDuplicateMessage
+}
+
+func (m *MongoRepository) Save(ctx context.Context, msg *models.Message) error {
+	ctx, cancel := withTimeout(ctx, m.writeTimeout)
 	defer cancel()
 	sort.Strings(msg.Participants)
 
-	_, err := m.collection.InsertOne(ctx, msg)
+	_, err := m.collection.InsertOne(ctx, msg, options.InsertOne().SetComment(comment(ctx)))
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) && writeErr.WriteConcernError == nil && len(writeErr.WriteErrors) == 1 {
+		return duplicateKey(writeErr.WriteErrors[0])
+	}
 	return err
 }
 
-func (m *MongoRepository) List() []*models.Message {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// SaveBatch inserts the messages with one unordered InsertMany, so a
+// failing message doesn't stop the ones after it. Messages already stored
+// are reported as ErrDuplicateMessage in the BatchError, retried sends as
+// ErrDuplicateClientMsgID.
+func (m *MongoRepository) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	ctx, cancel := withTimeout(ctx, m.writeTimeout)
+	defer cancel()
+	docs := make([]interface{}, len(msgs))
+	for i, msg := range msgs {
+		sort.Strings(msg.Participants)
+		docs[i] = msg
+	}
+
+	_, err := m.collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false).SetComment(comment(ctx)))
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return err
+	}
+
+	batchErr := &BatchError{Errors: make(map[int]error, len(bulkErr.WriteErrors))}
+	for _, we := range bulkErr.WriteErrors {
+		batchErr.Errors[we.Index] = duplicateKey(we.WriteError)
+	}
+	return batchErr
+}
+
+func (m *MongoRepository) List(ctx context.Context) []*models.Message {
+	ctx, cancel := withTimeout(ctx, m.readTimeout)
 	defer cancel()
 
-	cursor, err := m.collection.Find(ctx, bson.M{})
+	cursor, err := m.collection.Find(ctx, bson.M{}, options.Find().SetComment(comment(ctx)))
 	if err != nil {
 		return []*models.Message{}
 	}
@@ -81,17 +331,89 @@ func (m *MongoRepository) List() []*models.Message {
 	return messages
 }
 
+// NextSeq increments the channel's counter atomically, creating it on the
+// channel's first message
+func (m *MongoRepository) NextSeq(ctx context.Context, channelID string) (uint64, error) {
+	ctx, cancel := withTimeout(ctx, m.writeTimeout)
+	defer cancel()
+
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := m.counters.FindOneAndUpdate(ctx,
+		bson.M{"_id": channelID},
+		bson.M{"$inc": bson.M{"seq": int64(1)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After).SetComment(comment(ctx)),
+	).Decode(&counter)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(counter.Seq), nil
+}
+
+func (m *MongoRepository) GetMessageByClientMsgID(ctx context.Context, sender, clientMsgID string) (*models.Message, error) {
+	ctx, cancel := withTimeout(ctx, m.readTimeout)
+	defer cancel()
+
+	var msg models.Message
+	err := m.collection.FindOne(ctx,
+		bson.M{"sender": sender, "client_msg_id": clientMsgID},
+		options.FindOne().SetComment(comment(ctx)),
+	).Decode(&msg)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrMessageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (m *MongoRepository) GetMessagesBySeqRange(ctx context.Context, participants []string, fromSeq, toSeq uint64, limit int) ([]*models.Message, error) {
+	ctx, cancel := withTimeout(ctx, m.readTimeout)
+	defer cancel()
+	sorted := make([]string, len(participants))
+	copy(sorted, participants)
+	sort.Strings(sorted)
+	filter := bson.M{
+		"participants": sorted,
+		"seq":          bson.M{"$gte": int64(fromSeq), "$lte": int64(toSeq)},
+	}
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "seq", Value: 1}}).
+		SetLimit(int64(limit)).
+		SetComment(comment(ctx))
+
+	cursor, err := m.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var messages []*models.Message
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// newestFirst orders history by sequence number, which unlike created_at
+// doesn't depend on the clocks of the instances that accepted the messages.
+// Messages stored before sequence numbers existed have none and sort last.
+var newestFirst = bson.D{{Key: "seq", Value: -1}, {Key: "created_at", Value: -1}}
+
 // GetMessagesByParticipants retrieves all messages for a channel identified by its participants
 // The participants array should be sorted before calling this method
-func (m *MongoRepository) GetMessagesByParticipants(participants []string) ([]*models.Message, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (m *MongoRepository) GetMessagesByParticipants(ctx context.Context, participants []string) ([]*models.Message, error) {
+	ctx, cancel := withTimeout(ctx, m.readTimeout)
 	defer cancel()
 	sorted := make([]string, len(participants))
 	copy(sorted, participants)
 	sort.Strings(sorted)
-	filter := bson.M{"participants": sorted}
+	filter := bson.M{"participants": sorted, "duplicate_of": bson.M{"$exists": false}}
 
-	cursor, err := m.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	cursor, err := m.collection.Find(ctx, filter, options.Find().SetSort(newestFirst).SetComment(comment(ctx)))
 	if err != nil {
 		return nil, err
 	}
@@ -105,18 +427,19 @@ func (m *MongoRepository) GetMessagesByParticipants(participants []string) ([]*m
 	return messages, nil
 }
 
-func (m *MongoRepository) GetMessagesByParticipantsWithPagination(participants []string, page int, size int) ([]*models.Message, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func (m *MongoRepository) GetMessagesByParticipantsWithPagination(ctx context.Context, participants []string, page int, size int) ([]*models.Message, error) {
+	ctx, cancel := withTimeout(ctx, m.readTimeout)
 	defer cancel()
 	sorted := make([]string, len(participants))
 	copy(sorted, participants)
 	sort.Strings(sorted)
 	offset := int64(size * page)
-	filter := bson.M{"participants": sorted}
+	filter := bson.M{"participants": sorted, "duplicate_of": bson.M{"$exists": false}}
 	findOptions := options.Find().
-		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetSort(newestFirst).
 		SetSkip(offset).
-		SetLimit(int64(size))
+		SetLimit(int64(size)).
+		SetComment(comment(ctx))
 
 	cursor, err := m.collection.Find(ctx, filter, findOptions)
 	if err != nil {
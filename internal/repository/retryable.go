@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// retryableCodes are MongoDB server errors that go away on their own:
+// elections, shutdowns, network trouble, timeouts and write conflicts
+var retryableCodes = []int{
+	6,     // HostUnreachable
+	7,     // HostNotFound
+	50,    // MaxTimeMSExpired
+	64,    // WriteConcernFailed
+	89,    // NetworkTimeout
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	262,   // ExceededTimeLimit
+	9001,  // SocketException
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// Retryable tells whether an error of a repository call may go away if the
+// call is repeated. Duplicates, validation failures and other errors the
+// server would return again are permanent, as are calls canceled by their
+// caller. A *BatchError is retryable if any of its messages is. Errors the
+// driver can't classify, like failed server selection, count as transient.
+func Retryable(err error) bool {
+	var batchErr *BatchError
+	var writeErr mongo.WriteError
+	var serverErr mongo.ServerError
+	switch {
+	case err == nil, errors.Is(err, ErrDuplicateMessage), errors.Is(err, ErrDuplicateClientMsgID),
+		errors.Is(err, ErrMessageNotFound), errors.Is(err, context.Canceled):
+		return false
+	case errors.As(err, &batchErr):
+		for _, e := range batchErr.Errors {
+			if Retryable(e) {
+				return true
+			}
+		}
+		return false
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, context.DeadlineExceeded),
+		mongo.IsTimeout(err), mongo.IsNetworkError(err):
+		return true
+	case errors.As(err, &writeErr):
+		// What Save and SaveBatch report for a message that failed other
+		// than as a duplicate
+		return slices.Contains(retryableCodes, writeErr.Code)
+	case errors.As(err, &serverErr):
+		// Covers the write and bulk write exceptions too, through the codes
+		// of their write and write concern errors
+		if serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError") {
+			return true
+		}
+		return slices.ContainsFunc(retryableCodes, serverErr.HasErrorCode)
+	case errors.Is(err, mongo.ErrClientDisconnected), errors.Is(err, mongo.ErrNilDocument),
+		errors.Is(err, mongo.ErrUnacknowledgedWrite):
+		// Repeating an unacknowledged write can't make it report success
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"chat-microservice/internal/tracing"
+	"chat-microservice/pkg/models"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingRepository wraps a Repository and records a client span for every
+// call that reaches it. Wrap it in the CircuitBreaker, so calls the open
+// circuit rejects don't show up as database calls.
+type TracingRepository struct {
+	repo Repository
+}
+
+func NewTracingRepository(repo Repository) *TracingRepository {
+	return &TracingRepository{repo: repo}
+}
+
+func (t *TracingRepository) start(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, semconv.DBSystemNameMongoDB, semconv.DBOperationName(op))
+	return tracing.Start(ctx, "repository."+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func channelAttr(participants []string) attribute.KeyValue {
+	return attribute.String("chat.channel_id", models.CreateChannelID(participants))
+}
+
+func (t *TracingRepository) Save(ctx context.Context, msg *models.Message) error {
+	ctx, span := t.start(ctx, "Save", attribute.String("chat.message_id", msg.ID))
+	err := t.repo.Save(ctx, msg)
+	tracing.End(span, err)
+	return err
+}
+
+func (t *TracingRepository) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	ctx, span := t.start(ctx, "SaveBatch", semconv.DBOperationBatchSize(len(msgs)))
+	err := t.repo.SaveBatch(ctx, msgs)
+	tracing.End(span, err)
+	return err
+}
+
+// Ping isn't traced; readiness probes would drown the traces of messages
+func (t *TracingRepository) Ping(ctx context.Context) error {
+	if p, ok := t.repo.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (t *TracingRepository) List(ctx context.Context) []*models.Message {
+	ctx, span := t.start(ctx, "List")
+	defer span.End()
+	return t.repo.List(ctx)
+}
+
+func (t *TracingRepository) GetMessagesByParticipants(ctx context.Context, participants []string) ([]*models.Message, error) {
+	ctx, span := t.start(ctx, "GetMessagesByParticipants", channelAttr(participants))
+	msgs, err := t.repo.GetMessagesByParticipants(ctx, participants)
+	tracing.End(span, err)
+	return msgs, err
+}
+
+func (t *TracingRepository) GetMessagesByParticipantsWithPagination(ctx context.Context, participants []string, page int, size int) ([]*models.Message, error) {
+	ctx, span := t.start(ctx, "GetMessagesByParticipantsWithPagination", channelAttr(participants),
+		attribute.Int("chat.page", page), attribute.Int("chat.page_size", size))
+	msgs, err := t.repo.GetMessagesByParticipantsWithPagination(ctx, participants, page, size)
+	tracing.End(span, err)
+	return msgs, err
+}
+
+func (t *TracingRepository) NextSeq(ctx context.Context, channelID string) (uint64, error) {
+	ctx, span := t.start(ctx, "NextSeq", attribute.String("chat.channel_id", channelID))
+	seq, err := t.repo.NextSeq(ctx, channelID)
+	tracing.End(span, err)
+	return seq, err
+}
+
+func (t *TracingRepository) GetMessageByClientMsgID(ctx context.Context, sender, clientMsgID string) (*models.Message, error) {
+	ctx, span := t.start(ctx, "GetMessageByClientMsgID", attribute.String("chat.sender", sender))
+	msg, err := t.repo.GetMessageByClientMsgID(ctx, sender, clientMsgID)
+	if errors.Is(err, ErrMessageNotFound) {
+		// The usual outcome for a first send
+		span.SetAttributes(attribute.Bool("chat.found", false))
+		span.End()
+		return msg, err
+	}
+	tracing.End(span, err)
+	return msg, err
+}
+
+func (t *TracingRepository) GetMessagesBySeqRange(ctx context.Context, participants []string, fromSeq, toSeq uint64, limit int) ([]*models.Message, error) {
+	ctx, span := t.start(ctx, "GetMessagesBySeqRange", channelAttr(participants),
+		attribute.Int64("chat.from_seq", int64(fromSeq)), attribute.Int64("chat.to_seq", int64(toSeq)))
+	msgs, err := t.repo.GetMessagesBySeqRange(ctx, participants, fromSeq, toSeq, limit)
+	tracing.End(span, err)
+	return msgs, err
+}
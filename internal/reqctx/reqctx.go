@@ -0,0 +1,60 @@
+// Package reqctx carries request-scoped values from the HTTP layer down to
+// the data layer through context.Context.
+package reqctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	userIDKey
+)
+
+// WithRequestID returns a context carrying the id of the request it serves
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request id carried by ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithUserID returns a context carrying the authenticated user
+func WithUserID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, userIDKey, id)
+}
+
+// UserID returns the authenticated user carried by ctx, or "" if there is
+// none
+func UserID(ctx context.Context) string {
+	id, _ := ctx.Value(userIDKey).(string)
+	return id
+}
+
+// NewRequestID returns a random id for a request that arrived without one
+func NewRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Describe renders the values carried by ctx as "request=<id> user=<id>",
+// leaving out the missing ones, for log lines and database query comments
+func Describe(ctx context.Context) string {
+	var parts []string
+	if id := RequestID(ctx); id != "" {
+		parts = append(parts, "request="+id)
+	}
+	if id := UserID(ctx); id != "" {
+		parts = append(parts, "user="+id)
+	}
+	return strings.Join(parts, " ")
+}
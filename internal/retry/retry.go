@@ -0,0 +1,127 @@
+// Package retry repeats operations that failed for transient reasons,
+// waiting exponentially longer between attempts
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+)
+
+// ErrExhausted is returned by Backoff.Next once the policy allows no more
+// attempts
+var ErrExhausted = errors.New("retry attempts exhausted")
+
+// Policy shapes the delays between attempts and bounds how long an
+// operation is retried
+type Policy struct {
+	// MaxAttempts bounds the calls, the first one included; zero means no
+	// bound
+	MaxAttempts int
+	// InitialInterval is the delay after the first failure; every later one
+	// is Multiplier times the one before, up to MaxInterval
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter spreads every delay evenly over ±Jitter of it, from 0 to 1, so
+	// instances hit by the same outage don't retry in lockstep
+	Jitter float64
+	// MaxElapsedTime stops retrying once the next attempt would start this
+	// long after the first; zero means no bound
+	MaxElapsedTime time.Duration
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts:     5,
+		InitialInterval: 100 * time.Millisecond,
+		MaxInterval:     5 * time.Second,
+		Multiplier:      2,
+		Jitter:          0.2,
+		MaxElapsedTime:  30 * time.Second,
+	}
+}
+
+// Interval is the delay after the given failed attempt, counted from 1,
+// before jitter is applied
+func (p Policy) Interval(attempt int) time.Duration {
+	d := float64(p.InitialInterval)
+	for i := 1; i < attempt && (p.MaxInterval <= 0 || d < float64(p.MaxInterval)); i++ {
+		d *= max(p.Multiplier, 1)
+	}
+	if p.MaxInterval > 0 && d > float64(p.MaxInterval) {
+		return p.MaxInterval
+	}
+	return time.Duration(d)
+}
+
+// Start begins tracking the attempts of one operation
+func (p Policy) Start() *Backoff {
+	return &Backoff{policy: p, start: time.Now(), attempt: 1}
+}
+
+// Backoff tracks the attempts of one operation. It is not safe for
+// concurrent use.
+type Backoff struct {
+	policy  Policy
+	start   time.Time
+	attempt int
+}
+
+// Attempt is the number of the attempt being made, starting at 1
+func (b *Backoff) Attempt() int { return b.attempt }
+
+// Next waits before the next attempt. It returns ErrExhausted without
+// waiting once the policy allows no more attempts, and ctx's error if ctx
+// is done first.
+func (b *Backoff) Next(ctx context.Context) error {
+	p := b.policy
+	if p.MaxAttempts > 0 && b.attempt >= p.MaxAttempts {
+		return ErrExhausted
+	}
+
+	delay := p.Interval(b.attempt)
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * min(p.Jitter, 1) * float64(delay))
+	}
+	if p.MaxElapsedTime > 0 && time.Since(b.start)+delay > p.MaxElapsedTime {
+		return ErrExhausted
+	}
+	if err := Sleep(ctx, delay); err != nil {
+		return err
+	}
+	b.attempt++
+	return nil
+}
+
+// Sleep waits for d, or returns ctx's error if ctx is done first
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Do calls op until it succeeds, fails with an error retryable rejects or
+// the policy gives up, and returns op's last error. A nil retryable retries
+// every error. If ctx is done while waiting, ctx's error is returned.
+func Do(ctx context.Context, p Policy, retryable func(error) bool, op func(ctx context.Context) error) error {
+	b := p.Start()
+	for {
+		err := op(ctx)
+		if err == nil || (retryable != nil && !retryable(err)) {
+			return err
+		}
+		if waitErr := b.Next(ctx); waitErr != nil {
+			if errors.Is(waitErr, ErrExhausted) {
+				return err
+			}
+			return waitErr
+		}
+	}
+}
@@ -1,115 +1,712 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"chat-microservice/internal/metrics"
 	"chat-microservice/internal/repository"
+	"chat-microservice/internal/reqctx"
+	"chat-microservice/internal/retry"
+	"chat-microservice/internal/tracing"
 	"chat-microservice/internal/ws"
 	"chat-microservice/pkg/models"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrOverloaded is returned when a message can't be numbered or queued for
+// persistence within the enqueue timeout. Nothing was sent; the client
+// should retry later.
+var ErrOverloaded = errors.New("message pipeline saturated")
+
+// DeliveryMode decides whether messages are broadcast before or after they
+// are stored
+type DeliveryMode int
+
+const (
+	// DeliverAsync broadcasts a message as soon as it is accepted and
+	// persists it in the background. Sends are fast, but recipients may see
+	// a message that is lost if every save attempt fails.
+	DeliverAsync DeliveryMode = iota
+	// PersistThenBroadcast saves the message before broadcasting it and
+	// only reports success once it is stored, so recipients never see a
+	// message that isn't in the history
+	PersistThenBroadcast
 )
 
+func ParseDeliveryMode(s string) (DeliveryMode, error) {
+	switch s {
+	case "async":
+		return DeliverAsync, nil
+	case "persist":
+		return PersistThenBroadcast, nil
+	}
+	return DeliverAsync, fmt.Errorf("unknown delivery mode %q", s)
+}
+
+func (m DeliveryMode) String() string {
+	if m == PersistThenBroadcast {
+		return "persist"
+	}
+	return "async"
+}
+
+// Config controls how the service accepts and persists messages
+type Config struct {
+	// MaxRetries is how many times saving a message is attempted
+	MaxRetries int
+	// Retry shapes the delays between save attempts and bounds how long
+	// they go on; its MaxAttempts is replaced by MaxRetries. Only errors
+	// repository.Retryable accepts are retried.
+	Retry retry.Policy
+
+	// DeliveryMode chooses between broadcasting before or after the
+	// message is stored
+	DeliveryMode DeliveryMode
+
+	// In DeliverAsync mode each DB worker collects queued messages into
+	// batches of up to SaveBatchSize and stores them with one bulk insert.
+	// A batch is flushed once full or SaveBatchDelay after its first
+	// message, whichever comes first.
+	SaveBatchSize  int
+	SaveBatchDelay time.Duration
+
+	// DBWorkers store the messages waiting in a queue of DBQueueSize
+	DBWorkers   int
+	DBQueueSize int
+
+	// EnqueueTimeout bounds how long a send waits for its sequence number
+	// and for room in the DB queue before failing with ErrOverloaded, and
+	// how long it waits for room in the hub's shard queues before giving up
+	// on live delivery
+	EnqueueTimeout time.Duration
+
+	// Metrics, if set, receives the service's instrumentation; the service
+	// registers gauges for its queues, the hub and the circuit breaker on
+	// it, so a Metrics serves one service
+	Metrics *metrics.Metrics
+
+	// DedupWindow is how long a client_msg_id is remembered per sender. A
+	// send retried within the window returns the message accepted first
+	// instead of creating another; the repository's unique index catches
+	// retries that arrive later or at another instance. Zero disables it.
+	DedupWindow time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxRetries:   5,
+		Retry:        retry.DefaultPolicy(),
+		DeliveryMode: DeliverAsync,
+
+		SaveBatchSize:  100,
+		SaveBatchDelay: 10 * time.Millisecond,
+
+		DBWorkers:      4,
+		DBQueueSize:    1024,
+		EnqueueTimeout: 2 * time.Second,
+
+		DedupWindow: 10 * time.Minute,
+	}
+}
+
 type ChatService struct {
 	repo             repository.Repository
 	hub              *ws.Hub
-	maxRetries       int
-	dbWriteQueue     chan *models.Message
+	retryPolicy      retry.Policy
+	metrics          *metrics.Metrics
+	deliveryMode     DeliveryMode
+	saveBatchSize    int
+	saveBatchDelay   time.Duration
+	dedup            *dedupCache
+	dbWriteQueue     chan queuedMessage
 	numDBWokers      int
 	numDBJobQueue    int
 	dbWriteStopQueue chan bool
+	enqueueTimeout   time.Duration
+
+	// workerCtx is canceled stopFlushTimeout after Stop, ending the waits
+	// of DB workers that are still storing the queue
+	workerCtx     context.Context
+	cancelWorkers context.CancelFunc
+	workers       sync.WaitGroup
+	stopOnce      sync.Once
+
+	rejected          atomic.Uint64
+	broadcastTimeouts atomic.Uint64
+}
+
+// queuedMessage is a message waiting for a DB worker along with the span of
+// the send that accepted it, so the save can be linked back to the request
+type queuedMessage struct {
+	msg  *models.Message
+	span trace.SpanContext
+}
+
+// QueueStats describes how loaded the send pipeline is
+type QueueStats struct {
+	DBQueueDepth      int    `json:"db_queue_depth"`
+	DBQueueCapacity   int    `json:"db_queue_capacity"`
+	DBWorkers         int    `json:"db_workers"`
+	HubQueueDepth     int    `json:"hub_queue_depth"`
+	HubQueueCapacity  int    `json:"hub_queue_capacity"`
+	Rejected          uint64 `json:"rejected"`
+	BroadcastTimeouts uint64 `json:"broadcast_timeouts"`
 }
 
+// NewChatService creates a service with the default config and the given
+// number of save attempts
 func NewChatService(repo repository.Repository, hub *ws.Hub, maxRetries int) *ChatService {
+	cfg := DefaultConfig()
+	cfg.MaxRetries = maxRetries
+	return NewChatServiceWithConfig(repo, hub, cfg)
+}
+
+func NewChatServiceWithConfig(repo repository.Repository, hub *ws.Hub, cfg Config) *ChatService {
 	s := &ChatService{
 		repo:             repo,
 		hub:              hub,
-		maxRetries:       maxRetries,
-		dbWriteQueue:     make(chan *models.Message, 1024),
-		numDBWokers:      4,
-		numDBJobQueue:    1024,
+		retryPolicy:      cfg.Retry,
+		metrics:          cfg.Metrics,
+		deliveryMode:     cfg.DeliveryMode,
+		saveBatchSize:    max(cfg.SaveBatchSize, 1),
+		saveBatchDelay:   cfg.SaveBatchDelay,
+		dbWriteQueue:     make(chan queuedMessage, cfg.DBQueueSize),
+		numDBWokers:      max(cfg.DBWorkers, 1),
+		numDBJobQueue:    cfg.DBQueueSize,
 		dbWriteStopQueue: make(chan bool),
+		enqueueTimeout:   cfg.EnqueueTimeout,
 	}
 
+	s.workerCtx, s.cancelWorkers = context.WithCancel(context.Background())
+	s.retryPolicy.MaxAttempts = cfg.MaxRetries
+	s.registerMetrics()
+
+	s.workers.Add(s.numDBWokers)
 	for i := 0; i < s.numDBWokers; i++ {
 		go s.dbWorker()
 	}
 
+	if cfg.DedupWindow > 0 {
+		s.dedup = newDedupCache(cfg.DedupWindow)
+		go s.evictDedupEntries(cfg.DedupWindow)
+	}
+
 	return s
 }
 
+// evictDedupEntries periodically forgets client ids older than the window
+func (s *ChatService) evictDedupEntries(window time.Duration) {
+	ticker := time.NewTicker(window / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.dedup.evictExpired(now)
+		case <-s.dbWriteStopQueue:
+			return
+		}
+	}
+}
+
 func (s *ChatService) dbWorker() {
+	defer s.workers.Done()
 	log.Println("DB worker started")
+	// A batch mixes messages of many requests that may be long gone, so it
+	// is stored under the worker's own context, which outlives Stop by
+	// stopFlushTimeout
+	ctx := s.workerCtx
+	batch := make([]*models.Message, 0, s.saveBatchSize)
+	var links []trace.Link
+	timer := time.NewTimer(s.saveBatchDelay)
+	timer.Stop()
+	flush := func() {
+		timer.Stop()
+		if len(batch) > 0 {
+			// The batch starts a trace of its own, linked to the sends of
+			// its messages
+			ctx, span := tracing.Start(ctx, "ChatService.saveBatch",
+				trace.WithNewRoot(),
+				trace.WithLinks(links...),
+				trace.WithAttributes(attribute.Int("chat.batch_size", len(batch))),
+			)
+			s.saveBatch(ctx, batch)
+			span.End()
+			batch = make([]*models.Message, 0, s.saveBatchSize)
+			links = nil
+		}
+	}
+
+	// add takes a message into the batch, unless the worker ran out of
+	// time to store it after Stop
+	add := func(queued queuedMessage) {
+		if ctx.Err() != nil {
+			s.metrics.MessagesDropped(metrics.DropShutdown, 1)
+			log.Printf("DB worker stopped, not saving message %s", queued.msg.ID)
+			return
+		}
+		batch = append(batch, queued.msg)
+		if queued.span.IsValid() {
+			links = append(links, trace.Link{SpanContext: queued.span})
+		}
+	}
+
 	for {
 		select {
-		case msg := <-s.dbWriteQueue:
-			var lastErr error
-			for attempt := 1; attempt <= s.maxRetries; attempt++ {
-				err := s.repo.Save(msg)
-				if err == nil {
-					break
+		case queued := <-s.dbWriteQueue:
+			add(queued)
+			if len(batch) >= s.saveBatchSize {
+				flush()
+			} else if len(batch) == 1 {
+				timer.Reset(s.saveBatchDelay)
+			}
+		case <-timer.C:
+			flush()
+		case <-s.dbWriteStopQueue:
+			// The senders of queued messages were told they were accepted,
+			// so the queue is stored before stopping, as far as time allows
+		drain:
+			for {
+				select {
+				case queued := <-s.dbWriteQueue:
+					add(queued)
+					if len(batch) >= s.saveBatchSize {
+						flush()
+					}
+				default:
+					break drain
 				}
-				lastErr = err
-				log.Printf("failed to save message (attempt %d/%d): %v", attempt, s.maxRetries, err)
-				if attempt < s.maxRetries {
-					time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+			}
+			flush()
+			log.Println("DB worker stopped")
+			return
+		}
+	}
+}
+
+// stopFlushTimeout bounds how long Stop lets the DB workers store the
+// messages still queued
+const stopFlushTimeout = 5 * time.Second
+
+// circuitPollInterval is how often DB workers check whether an open
+// circuit let their batch through
+const circuitPollInterval = 100 * time.Millisecond
+
+// saveBatch stores messages with one bulk insert, retrying only those that
+// failed for transient reasons. Messages that turn out to be stored
+// already count as saved.
+func (s *ChatService) saveBatch(ctx context.Context, msgs []*models.Message) {
+	span := trace.SpanFromContext(ctx)
+	pending := msgs
+	backoff := s.retryPolicy.Start()
+	for {
+		start := time.Now()
+		err := s.repo.SaveBatch(ctx, pending)
+		s.metrics.ObserveSave(metrics.OpSaveBatch, time.Since(start))
+		if err == nil {
+			s.metrics.MessagesPersisted(len(pending))
+			return
+		}
+
+		var batchErr *repository.BatchError
+		if errors.As(err, &batchErr) {
+			var failed, placeholders []*models.Message
+			for i, msg := range pending {
+				itemErr, ok := batchErr.Errors[i]
+				switch {
+				case !ok, errors.Is(itemErr, repository.ErrDuplicateMessage):
+					s.metrics.MessagesPersisted(1)
+				case errors.Is(itemErr, repository.ErrDuplicateClientMsgID):
+					// A retry of a send that was still queued elsewhere when
+					// this one was accepted. Only the original is kept, and
+					// a placeholder pointing at it takes the sequence number
+					// this one was broadcast with.
+					original, err := s.repo.GetMessageByClientMsgID(ctx, msg.Sender, msg.ClientMsgID)
+					if err != nil {
+						s.metrics.MessagesDropped(metrics.DropDuplicate, 1)
+						log.Printf("not saving duplicate message %s, nor a placeholder for seq %d: %v", msg.ID, msg.Seq, err)
+						continue
+					}
+					log.Printf("not saving message %s: sender %s already stored client_msg_id %q as %s", msg.ID, msg.Sender, msg.ClientMsgID, original.ID)
+					placeholders = append(placeholders, msg.Placeholder(original.ID))
+				case !repository.Retryable(itemErr):
+					s.metrics.MessagesDropped(metrics.DropPermanent, 1)
+					tracing.Fail(span, itemErr)
+					log.Printf("failed to save message %s, not retrying: %v", msg.ID, itemErr)
+				default:
+					failed = append(failed, msg)
 				}
 			}
-			if lastErr != nil {
-				log.Printf("failed to save message after %d attempts: %v", s.maxRetries, lastErr)
+			if len(failed)+len(placeholders) == 0 {
+				return
 			}
-		case <-s.dbWriteStopQueue:
-			log.Println("DB worker stopped")
+			pending = append(failed, placeholders...)
+			// Placeholders are new documents, stored right away
+			if len(placeholders) > 0 {
+				continue
+			}
+		}
+
+		if ctx.Err() != nil {
+			s.metrics.MessagesDropped(metrics.DropSaveFailed, len(pending))
+			tracing.Fail(span, err)
+			log.Printf("failed to save %d messages, stopping: %v", len(pending), err)
+			return
+		}
+
+		// Queued messages wait for the circuit to close instead of spending
+		// their attempts on a database that is known to be down, and start
+		// over once it has
+		if errors.Is(err, repository.ErrCircuitOpen) || s.storageDown() {
+			if err := retry.Sleep(ctx, circuitPollInterval); err != nil {
+				s.metrics.MessagesDropped(metrics.DropSaveFailed, len(pending))
+				tracing.Fail(span, err)
+				log.Printf("failed to save %d messages: %v", len(pending), err)
+				return
+			}
+			backoff = s.retryPolicy.Start()
+			continue
+		}
+		if !repository.Retryable(err) {
+			s.metrics.MessagesDropped(metrics.DropPermanent, len(pending))
+			tracing.Fail(span, err)
+			log.Printf("failed to save %d messages, not retrying: %v", len(pending), err)
+			return
+		}
+
+		log.Printf("failed to save %d messages (attempt %d/%d): %v", len(pending), backoff.Attempt(), s.retryPolicy.MaxAttempts, err)
+		if waitErr := backoff.Next(ctx); waitErr != nil {
+			s.metrics.MessagesDropped(metrics.DropSaveFailed, len(pending))
+			tracing.Fail(span, err)
+			log.Printf("failed to save %d messages after %d attempts: %v", len(pending), backoff.Attempt(), err)
 			return
 		}
+		s.metrics.SaveRetried()
+		span.AddEvent("retry", trace.WithAttributes(attribute.Int("chat.attempt", backoff.Attempt()), attribute.Int("chat.pending", len(pending))))
 	}
 }
 
+// save stores a message, retrying transient failures until the retry
+// policy gives up or ctx is done
+func (s *ChatService) save(ctx context.Context, msg *models.Message) (err error) {
+	ctx, span := tracing.Start(ctx, "ChatService.save")
+	attempt := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("chat.attempts", attempt))
+		tracing.End(span, err)
+	}()
+
+	return retry.Do(ctx, s.retryPolicy, retryableSave, func(ctx context.Context) error {
+		attempt++
+		if attempt > 1 {
+			s.metrics.SaveRetried()
+		}
+		start := time.Now()
+		err := s.repo.Save(ctx, msg)
+		s.metrics.ObserveSave(metrics.OpSave, time.Since(start))
+		// An earlier attempt already stored it. A clash of client_msg_id is
+		// another message and is left to the caller.
+		if err == nil || errors.Is(err, repository.ErrDuplicateMessage) {
+			s.metrics.MessagesPersisted(1)
+			return nil
+		}
+		if err != nil {
+			log.Printf("failed to save message (attempt %d/%d, %s): %v", attempt, s.retryPolicy.MaxAttempts, reqctx.Describe(ctx), err)
+		}
+		return err
+	})
+}
+
+// retryableSave tells which errors of a sender's save are worth waiting
+// for. An open circuit is reported right away; the sender is better off
+// retrying later.
+func retryableSave(err error) bool {
+	return !errors.Is(err, repository.ErrCircuitOpen) && repository.Retryable(err)
+}
+
+// Stop ends the DB workers once they have stored the messages still
+// queued, and returns when they are done. Whatever isn't stored within
+// stopFlushTimeout, e.g. because the circuit stays open, is dropped and
+// counted in the metrics. Messages queued after Stop are never stored.
 func (s *ChatService) Stop() {
-	close(s.dbWriteStopQueue)
+	s.stopOnce.Do(func() {
+		close(s.dbWriteStopQueue)
+		timer := time.AfterFunc(stopFlushTimeout, s.cancelWorkers)
+		s.workers.Wait()
+		timer.Stop()
+		s.cancelWorkers()
+	})
 }
 
 func (s *ChatService) Hub() *ws.Hub { return s.hub }
 
-func (s *ChatService) BroadcastMessage(m *models.Message) error {
+func (s *ChatService) DeliveryMode() DeliveryMode { return s.deliveryMode }
+
+// QueueStats reports the depth of the DB and hub queues and how many sends
+// were turned away or not broadcast because they were full
+func (s *ChatService) QueueStats() QueueStats {
+	hubCfg := s.hub.Config()
+	return QueueStats{
+		DBQueueDepth:      len(s.dbWriteQueue),
+		DBQueueCapacity:   s.numDBJobQueue,
+		DBWorkers:         s.numDBWokers,
+		HubQueueDepth:     s.hub.QueueDepth(),
+		HubQueueCapacity:  max(hubCfg.Shards, 1) * hubCfg.ShardQueueSize,
+		Rejected:          s.rejected.Load(),
+		BroadcastTimeouts: s.broadcastTimeouts.Load(),
+	}
+}
+
+// StorageStats reports the state of the repository's circuit breaker, if it
+// has one
+func (s *ChatService) StorageStats() (repository.BreakerStats, bool) {
+	breaker, ok := s.repo.(*repository.CircuitBreaker)
+	if !ok {
+		return repository.BreakerStats{}, false
+	}
+	return breaker.Stats(), true
+}
+
+// PingStorage checks the repository's connection to the database, if the
+// repository can
+func (s *ChatService) PingStorage(ctx context.Context) error {
+	if p, ok := s.repo.(repository.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// storageDown tells whether the repository's circuit breaker is letting
+// calls through only as probes, or not at all
+func (s *ChatService) storageDown() bool {
+	stats, ok := s.StorageStats()
+	return ok && stats.State != repository.BreakerClosed
+}
+
+// BroadcastMessage assigns the message its id and the next sequence number
+// of its channel, persists it or queues it for persistence, depending on
+// the delivery mode, and delivers it to the participants. originSessionID
+// is the sender's session the message came from, if known; it is skipped
+// when echoing to the sender's devices.
+//
+// Waits for queue room are bounded by ctx and the enqueue timeout. A
+// message that can't be queued for persistence fails with ErrOverloaded.
+// Once it is accepted, live delivery is best effort: if the hub's queues
+// stay full, participants that missed it notice the gap in sequence
+// numbers and fetch it from the history.
+//
+// If the sender already sent a message with the same ClientMsgID, within
+// the dedup window or stored by any instance, nothing is sent and that
+// message is returned with duplicate set.
+func (s *ChatService) BroadcastMessage(ctx context.Context, m *models.Message, originSessionID string) (accepted *models.Message, duplicate bool, err error) {
 	// Sort participants to ensure consistency
 	sort.Strings(m.Participants)
+	if m.ID == "" {
+		m.ID = models.NewID()
+	}
+
+	ctx, span := tracing.Start(ctx, "ChatService.BroadcastMessage", trace.WithAttributes(
+		attribute.String("chat.message_id", m.ID),
+		attribute.String("chat.channel_id", models.CreateChannelID(m.Participants)),
+		attribute.Int("chat.participants", len(m.Participants)),
+		attribute.String("chat.delivery_mode", s.deliveryMode.String()),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Bool("chat.duplicate", duplicate))
+		tracing.End(span, err)
+	}()
 
-	b, err := json.Marshal(m)
+	var claim *dedupEntry
+	if m.ClientMsgID != "" && s.dedup != nil {
+		e, dup := s.dedup.claim(m, time.Now())
+		if dup {
+			original, err := e.wait()
+			if err != nil {
+				return nil, false, err
+			}
+			return original, true, nil
+		}
+		claim = e
+	}
+
+	stored, err := s.accept(ctx, m)
+	if claim != nil {
+		if stored != nil {
+			claim.msg = stored
+		}
+		s.dedup.settle(claim, err)
+	}
 	if err != nil {
-		return err
+		return nil, false, err
+	}
+	if stored != nil {
+		return stored, true, nil
 	}
+	s.metrics.MessageAccepted()
+	span.SetAttributes(attribute.Int64("chat.seq", int64(m.Seq)))
 
+	// The hub encodes the message for each wire format its recipients use
 	broadcastMessage := &ws.BroadcastMessage{
-		Participants: m.Participants,
-		Message:      b,
-		SenderID:     m.Sender,
+		Participants:    m.Participants,
+		Message:         m,
+		SenderID:        m.Sender,
+		OriginSessionID: originSessionID,
 	}
 
-	s.hub.Broadcast <- broadcastMessage
+	// The message is accepted, so deliver it even if the sender goes away
+	broadcastCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.enqueueTimeout)
+	defer cancel()
+	if err := s.hub.BroadcastContext(broadcastCtx, broadcastMessage); err != nil {
+		s.broadcastTimeouts.Add(1)
+		log.Printf("hub queues full, message %s not broadcast to every participant: %v", m.ID, err)
+	} else {
+		s.metrics.MessageBroadcast()
+	}
 
-	s.dbWriteQueue <- m
+	return m, false, nil
+}
 
-	return nil
+// accept numbers the message and stores it or queues it for the DB workers.
+// A message that fails to be stored or queued leaves a gap in the channel's
+// sequence numbers. Numbering calls the repository even when the message is
+// queued, so async delivery still fails while the repository is down; it
+// waits at most the enqueue timeout, like the queue.
+//
+// A retried send that got past the dedup cache, because it came after the
+// window or reached another instance, isn't accepted again: the message
+// stored for its client_msg_id is returned instead.
+func (s *ChatService) accept(ctx context.Context, m *models.Message) (stored *models.Message, err error) {
+	stored, err = s.number(ctx, m)
+	if stored != nil || err != nil {
+		return stored, err
+	}
+
+	if s.deliveryMode == PersistThenBroadcast {
+		err := s.save(ctx, m)
+		// Another instance stored the same send since the lookup
+		if errors.Is(err, repository.ErrDuplicateClientMsgID) {
+			return s.storeDuplicate(ctx, m)
+		}
+		return nil, err
+	}
+	return nil, s.enqueue(ctx, m)
+}
+
+// number looks up a stored message with the client_msg_id of m, returning
+// it if there is one, and otherwise gives m the channel's next sequence
+// number. A slow repository fails the send with ErrOverloaded after the
+// enqueue timeout.
+func (s *ChatService) number(ctx context.Context, m *models.Message) (stored *models.Message, err error) {
+	numberCtx, cancel := context.WithTimeout(ctx, s.enqueueTimeout)
+	defer cancel()
+	defer func() {
+		if err != nil && ctx.Err() == nil && numberCtx.Err() != nil {
+			s.rejected.Add(1)
+			log.Printf("numbering message took over %s, rejecting it: %v", s.enqueueTimeout, err)
+			err = ErrOverloaded
+		}
+	}()
+
+	if m.ClientMsgID != "" {
+		stored, err := s.repo.GetMessageByClientMsgID(numberCtx, m.Sender, m.ClientMsgID)
+		if !errors.Is(err, repository.ErrMessageNotFound) {
+			return stored, err
+		}
+	}
+
+	// Sequence numbers come from the repository so they are shared by all
+	// instances; clients use them to order messages and to detect gaps
+	seq, err := s.repo.NextSeq(numberCtx, models.CreateChannelID(m.Participants))
+	if err != nil {
+		log.Printf("failed to assign sequence number: %v", err)
+		return nil, err
+	}
+	m.Seq = seq
+	return nil, nil
+}
+
+// storeDuplicate handles a persist-mode send that lost the race for its
+// client_msg_id: the original is returned and a placeholder takes the
+// sequence number the send was given, so clients filling gaps find it.
+func (s *ChatService) storeDuplicate(ctx context.Context, m *models.Message) (*models.Message, error) {
+	stored, err := s.repo.GetMessageByClientMsgID(ctx, m.Sender, m.ClientMsgID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(ctx, m.Placeholder(stored.ID)); err != nil {
+		log.Printf("failed to store placeholder for seq %d of duplicate %s: %v", m.Seq, m.ID, err)
+	}
+	return stored, nil
+}
+
+// enqueue hands a message to the DB workers, waiting at most the enqueue
+// timeout for room in the queue. The message carries the span of ctx along.
+func (s *ChatService) enqueue(ctx context.Context, m *models.Message) error {
+	queued := queuedMessage{msg: m, span: trace.SpanContextFromContext(ctx)}
+	select {
+	case s.dbWriteQueue <- queued:
+		return nil
+	default:
+	}
+
+	trace.SpanFromContext(ctx).AddEvent("waiting for DB queue room")
+	timer := time.NewTimer(s.enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case s.dbWriteQueue <- queued:
+		return nil
+	case <-timer.C:
+		s.rejected.Add(1)
+		log.Printf("DB queue full for %s, rejecting message", s.enqueueTimeout)
+		return ErrOverloaded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *ChatService) GetMessagesForChannel(ctx context.Context, participants []string, userID string) ([]*models.Message, error) {
+	if !models.ContainsUser(participants, userID) {
+		return []*models.Message{}, nil
+	}
+
+	sort.Strings(participants)
+	ctx, span := tracing.Start(ctx, "ChatService.GetMessagesForChannel")
+	defer span.End()
+
+	return s.repo.GetMessagesByParticipants(ctx, participants)
 }
 
-func (s *ChatService) GetMessagesForChannel(participants []string, userID string) ([]*models.Message, error) {
+func (s *ChatService) GetMessagesForChannelWithPagination(ctx context.Context, participants []string, userID string, page int, size int) ([]*models.Message, error) {
 	if !models.ContainsUser(participants, userID) {
 		return []*models.Message{}, nil
 	}
 
 	sort.Strings(participants)
+	ctx, span := tracing.Start(ctx, "ChatService.GetMessagesForChannelWithPagination")
+	defer span.End()
 
-	return s.repo.GetMessagesByParticipants(participants)
+	return s.repo.GetMessagesByParticipantsWithPagination(ctx, participants, page, size)
 }
 
-func (s *ChatService) GetMessagesForChannelWithPagination(participants []string, userID string, page int, size int) ([]*models.Message, error) {
+// GetMessagesForChannelBySeq returns up to limit stored messages of a
+// channel with sequence numbers from fromSeq to toSeq, for clients filling
+// a gap. Messages still waiting in the write queue aren't found yet.
+func (s *ChatService) GetMessagesForChannelBySeq(ctx context.Context, participants []string, userID string, fromSeq, toSeq uint64, limit int) ([]*models.Message, error) {
 	if !models.ContainsUser(participants, userID) {
 		return []*models.Message{}, nil
 	}
 
 	sort.Strings(participants)
+	ctx, span := tracing.Start(ctx, "ChatService.GetMessagesForChannelBySeq")
+	defer span.End()
 
-	return s.repo.GetMessagesByParticipantsWithPagination(participants, page, size)
+	return s.repo.GetMessagesBySeqRange(ctx, participants, fromSeq, toSeq, limit)
 }
@@ -0,0 +1,87 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"chat-microservice/pkg/models"
+)
+
+// dedupCache remembers the messages accepted with a client_msg_id so a send
+// retried within the window returns the original instead of creating a
+// duplicate. Keys are scoped to the sender, since clients choose the ids.
+type dedupCache struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[dedupKey]*dedupEntry
+}
+
+type dedupKey struct {
+	sender      string
+	clientMsgID string
+}
+
+// dedupEntry is claimed before the message is accepted; done is closed once
+// accepting it succeeded or failed, so retries racing the first send wait
+// for its outcome
+type dedupEntry struct {
+	key     dedupKey
+	msg     *models.Message
+	expires time.Time
+	done    chan struct{}
+	err     error
+}
+
+func newDedupCache(window time.Duration) *dedupCache {
+	return &dedupCache{
+		window:  window,
+		entries: make(map[dedupKey]*dedupEntry),
+	}
+}
+
+// claim records m under its sender and client id unless a message was
+// already claimed with them within the window, in which case that entry is
+// returned with duplicate set
+func (d *dedupCache) claim(m *models.Message, now time.Time) (e *dedupEntry, duplicate bool) {
+	key := dedupKey{sender: m.Sender, clientMsgID: m.ClientMsgID}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.entries[key]; ok && now.Before(e.expires) {
+		return e, true
+	}
+	e = &dedupEntry{key: key, msg: m, expires: now.Add(d.window), done: make(chan struct{})}
+	d.entries[key] = e
+	return e, false
+}
+
+// settle publishes the outcome of accepting a claimed message. A failed one
+// is forgotten so the client's retry is accepted afresh.
+func (d *dedupCache) settle(e *dedupEntry, err error) {
+	if err != nil {
+		d.mu.Lock()
+		if d.entries[e.key] == e {
+			delete(d.entries, e.key)
+		}
+		d.mu.Unlock()
+	}
+	e.err = err
+	close(e.done)
+}
+
+// wait returns the message accepted for a claimed entry
+func (e *dedupEntry) wait() (*models.Message, error) {
+	<-e.done
+	return e.msg, e.err
+}
+
+// evictExpired drops entries older than the window
+func (d *dedupCache) evictExpired(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key, e := range d.entries {
+		if !now.Before(e.expires) {
+			delete(d.entries, key)
+		}
+	}
+}
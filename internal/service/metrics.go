@@ -0,0 +1,53 @@
+package service
+
+// registerMetrics exposes the levels and totals the service, its hub and
+// its circuit breaker already keep, read at every scrape
+func (s *ChatService) registerMetrics() {
+	m := s.metrics
+	if m == nil {
+		return
+	}
+
+	m.Gauge("db_queue_depth", "Messages waiting for a DB worker.", func() float64 {
+		return float64(len(s.dbWriteQueue))
+	})
+	m.Gauge("db_queue_capacity", "Messages the DB queue holds.", func() float64 {
+		return float64(s.numDBJobQueue)
+	})
+	m.Gauge("hub_queue_depth", "Broadcast jobs queued in the hub's shards or being delivered.", func() float64 {
+		return float64(s.hub.QueueDepth())
+	})
+	m.Counter("messages_rejected_total", "Sends answered 503 because the DB queue stayed full.", func() float64 {
+		return float64(s.rejected.Load())
+	})
+	m.Counter("broadcast_timeouts_total", "Accepted messages that couldn't be queued in every hub shard in time.", func() float64 {
+		return float64(s.broadcastTimeouts.Load())
+	})
+
+	m.GaugeVec("connections", "Subscribers registered with the hub by transport.", "transport", func() map[string]float64 {
+		counts := make(map[string]float64)
+		for transport, n := range s.hub.ConnectionStats().ByTransport {
+			counts[transport] = float64(n)
+		}
+		return counts
+	})
+	m.Gauge("connected_users", "Users with at least one subscriber.", func() float64 {
+		return float64(s.hub.ConnectionStats().Users)
+	})
+
+	if _, ok := s.StorageStats(); !ok {
+		return
+	}
+	m.Gauge("storage_circuit_state", "State of the MongoDB circuit breaker: 0 closed, 1 open, 2 half-open.", func() float64 {
+		stats, _ := s.StorageStats()
+		return float64(stats.State)
+	})
+	m.Counter("storage_circuit_trips_total", "Times the MongoDB circuit breaker opened.", func() float64 {
+		stats, _ := s.StorageStats()
+		return float64(stats.Trips)
+	})
+	m.Counter("storage_circuit_rejections_total", "Database calls failed by the open circuit without being tried.", func() float64 {
+		stats, _ := s.StorageStats()
+		return float64(stats.Rejected)
+	})
+}
@@ -0,0 +1,158 @@
+// Package tracing sets up OpenTelemetry and starts the spans that follow a
+// message from the HTTP handler through the hub and the DB workers. Spans
+// go to the global tracer provider, which records nothing until Setup
+// installs an exporter, so packages trace unconditionally.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"chat-microservice/internal/httpx"
+	"chat-microservice/internal/reqctx"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "chat-microservice"
+
+// Exporters Setup can send spans to
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config chooses where spans are exported and how many traces are kept
+type Config struct {
+	// Exporter is ExporterNone, ExporterStdout or ExporterOTLP. OTLP is
+	// sent over HTTP to the collector named by the standard
+	// OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_HEADERS variables.
+	Exporter    string
+	ServiceName string
+	// SampleRatio is the share of new traces recorded. Requests carrying a
+	// traceparent header follow their caller's decision.
+	SampleRatio float64
+	// Stdout receives the spans of ExporterStdout, os.Stdout if nil
+	Stdout io.Writer
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Exporter:    ExporterNone,
+		ServiceName: instrumentationName,
+		SampleRatio: 1,
+	}
+}
+
+// Setup installs the W3C trace context propagator and, unless the exporter
+// is ExporterNone, a tracer provider exporting to it. The returned function
+// flushes the spans still buffered and must be called before exiting.
+func Setup(ctx context.Context, cfg Config) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		w := cfg.Stdout
+		if w == nil {
+			w = os.Stdout
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	case ExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(cfg.ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of the service as a child of the span in ctx, if any
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// Fail records err on span and marks the span failed
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End marks span failed if err is set and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		Fail(span, err)
+	}
+	span.End()
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// of a traceparent header if the request has one. Spans are named after the
+// method and the route the request matches, so paths with ids share a name.
+// Streaming routes span their whole connection.
+func Middleware(routes []string, next http.Handler) http.Handler {
+	lookup := httpx.NewRoutes(routes)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := lookup.Match(r)
+		// Patterns may start with their method already
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("request.id", reqctx.RequestID(ctx)),
+			),
+		)
+		defer span.End()
+
+		rec := httpx.NewStatusRecorder(w)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		status := rec.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	})
+}
@@ -0,0 +1,120 @@
+package ws
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Config controls how the hub is partitioned, how it treats inbound frames
+// from clients, how it sheds load when clients can't keep up with outbound
+// ones and how outbound frames are written
+type Config struct {
+	// Shards is the number of partitions users are hashed into. Each shard
+	// has its own broadcast queue of ShardQueueSize jobs drained by
+	// WorkersPerShard workers. With more than one worker per shard, messages
+	// to the same user may be delivered out of order.
+	Shards          int
+	WorkersPerShard int
+	ShardQueueSize  int
+
+	// LogConnections logs every registration and unregistration
+	LogConnections bool
+
+	// MaxFrameSize is the largest frame in bytes a client may send; larger
+	// frames close the connection
+	MaxFrameSize int64
+
+	// Keepalive defaults: the server pings every PingPeriod and drops
+	// connections it hasn't heard from for PongWait, which must be longer.
+	// WriteWait bounds every write. Clients may ask for a ping interval
+	// within [MinPingPeriod, MaxPingPeriod] at handshake.
+	PingPeriod    time.Duration
+	PongWait      time.Duration
+	WriteWait     time.Duration
+	MinPingPeriod time.Duration
+	MaxPingPeriod time.Duration
+
+	// Token buckets for inbound frames, per connection and shared by all
+	// connections of a user
+	ConnFrameRate  rate.Limit
+	ConnFrameBurst int
+	UserFrameRate  rate.Limit
+	UserFrameBurst int
+
+	// Escalation for clients exceeding their buckets: frames are dropped, at
+	// WarnAfter strikes the client receives a warning frame and at CloseAfter
+	// strikes the connection is closed with a policy violation. Strikes are
+	// forgotten after StrikeWindow without violations.
+	WarnAfter    int
+	CloseAfter   int
+	StrikeWindow time.Duration
+
+	// SendQueueSize bounds the frames queued for each client. When a queue is
+	// full OverflowPolicy applies; Disconnect waits OverflowGrace before
+	// dropping the client and Coalesce merges frames up to CoalesceMaxBytes.
+	SendQueueSize    int
+	OverflowPolicy   OverflowPolicy
+	OverflowGrace    time.Duration
+	CoalesceMaxBytes int
+
+	// Compression negotiates permessage-deflate with clients that support
+	// it. Frames smaller than CompressionThreshold bytes are sent
+	// uncompressed; CompressionLevel is a compress/flate level from 1 to 9.
+	Compression          bool
+	CompressionThreshold int
+	CompressionLevel     int
+
+	// WriteBatching lets writePump merge the frames it drains from an outbox
+	// into one WebSocket frame of up to WriteBatchMaxBytes, using the same
+	// framing as Coalesce. It only applies to clients that negotiated a
+	// subprotocol: a plain JSON client expects one message per frame.
+	WriteBatching      bool
+	WriteBatchMaxBytes int
+
+	// ReplayBufferSize is how many recent messages are kept per user for SSE
+	// and long-poll clients resuming with Last-Event-ID. Buffers outlive the
+	// user's last subscriber by ReplayWindow. Zero disables replay.
+	ReplayBufferSize int
+	ReplayWindow     time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		Shards:          16,
+		WorkersPerShard: 1,
+		ShardQueueSize:  1024,
+		LogConnections:  true,
+
+		MaxFrameSize: 512,
+
+		PingPeriod:    54 * time.Second,
+		PongWait:      60 * time.Second,
+		WriteWait:     10 * time.Second,
+		MinPingPeriod: 5 * time.Second,
+		MaxPingPeriod: 5 * time.Minute,
+
+		ConnFrameRate:  rate.Limit(10),
+		ConnFrameBurst: 20,
+		UserFrameRate:  rate.Limit(20),
+		UserFrameBurst: 40,
+		WarnAfter:      5,
+		CloseAfter:     20,
+		StrikeWindow:   10 * time.Second,
+
+		SendQueueSize:    256,
+		OverflowPolicy:   DropOldest,
+		OverflowGrace:    5 * time.Second,
+		CoalesceMaxBytes: 64 * 1024,
+
+		Compression:          true,
+		CompressionThreshold: 1024,
+		CompressionLevel:     1,
+
+		WriteBatching:      true,
+		WriteBatchMaxBytes: 64 * 1024,
+
+		ReplayBufferSize: 256,
+		ReplayWindow:     2 * time.Minute,
+	}
+}
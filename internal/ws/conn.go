@@ -1,42 +1,146 @@
 package ws
 
 import (
+	"encoding/json"
 	"log"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
 )
 
 type Client struct {
 	hub    *Hub
 	conn   *websocket.Conn
-	send   chan []byte
+	out    *outbox
 	userID string
+	codec  Codec // negotiated through the WebSocket subprotocol
+	// batching is set when WriteBatching is on and the client negotiated a
+	// subprotocol, which tells us it splits frames with the codec
+	batching bool
+
+	session Session
+	// closeMessage replaces the empty close frame sent once the outbox is
+	// closed, e.g. to tell a remotely terminated session not to reconnect
+	closeMessage atomic.Pointer[[]byte]
+
+	keepalive Keepalive
+	stats     connStats
+	// lastPing is the payload of the last ping written, the UnixNano time
+	// it was sent; pongs echoing anything else aren't timed
+	lastPing atomic.Int64
+
+	// control carries server-originated frames from readPump to writePump so
+	// they are written in order
+	control chan outboundFrame
+
+	connLimiter   *rate.Limiter
+	userLimiter   *rate.Limiter // set by Hub.Register
+	strikes       int
+	lastViolation time.Time
+	closing       bool
+}
+
+type outboundFrame struct {
+	messageType int
+	data        []byte
+}
+
+// controlFrame is sent by the server to tell a client about its own
+// connection rather than about chat messages
+type controlFrame struct {
+	Type    string `json:"type"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// helloFrame is the first frame on every connection. Browsers can't read
+// the handshake's response headers, so what the client needs to know about
+// its own connection is sent in-band.
+type helloFrame struct {
+	Type      string `json:"type"`
+	SessionID string `json:"session_id"`
+	// The keepalive negotiated for this connection
+	PingIntervalSec int `json:"ping_interval_sec"`
+	PongTimeoutSec  int `json:"pong_timeout_sec"`
 }
 
+// ClientOptions are per-connection settings negotiated at handshake
+type ClientOptions struct {
+	Keepalive Keepalive
+	// Session describes the connection to the user's other devices; its ID
+	// and ConnectedAt are filled in when empty
+	Session Session
+}
+
+// NewClient wraps an upgraded connection with the hub's default settings
 func NewClient(conn *websocket.Conn, hub *Hub, userID string) *Client {
+	return NewClientWithOptions(conn, hub, userID, ClientOptions{Keepalive: hub.cfg.Keepalive()})
+}
+
+// NewClientWithOptions wraps an upgraded connection. Messages are encoded
+// with the codec of the subprotocol negotiated during the upgrade, JSON if
+// there was none.
+func NewClientWithOptions(conn *websocket.Conn, hub *Hub, userID string, opts ClientOptions) *Client {
+	codec := JSONCodec
+	batching := false
+	if conn != nil {
+		codec = CodecForSubprotocol(conn.Subprotocol())
+		batching = hub.cfg.WriteBatching && conn.Subprotocol() != ""
+		if hub.cfg.Compression {
+			conn.SetCompressionLevel(hub.cfg.CompressionLevel)
+		}
+	}
+
 	return &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		userID: userID,
+		hub:         hub,
+		conn:        conn,
+		out:         newOutbox(hub.cfg, codec),
+		userID:      userID,
+		codec:       codec,
+		batching:    batching,
+		session:     newSession(opts.Session, TransportWebSocket),
+		keepalive:   opts.Keepalive,
+		control:     make(chan outboundFrame, 2),
+		connLimiter: rate.NewLimiter(hub.cfg.ConnFrameRate, hub.cfg.ConnFrameBurst),
 	}
 }
 
+func (c *Client) UserID() string   { return c.userID }
+func (c *Client) Session() Session { return c.session }
+func (c *Client) Codec() Codec     { return c.codec }
+
+// Push queues a frame in the client's outbox. WebSocket frames carry no
+// event id; clients that need to resume use an HTTP transport.
+func (c *Client) Push(_ EventID, frame []byte, now time.Time) bool {
+	return c.out.push(frame, now)
+}
+
+// Close makes writePump flush the outbox and shut the connection down
+func (c *Client) Close() {
+	c.out.close()
+}
+
+func (c *Client) setCloseMessage(msg []byte) {
+	c.closeMessage.Store(&msg)
+}
+
 func (c *Client) Start() {
-	c.hub.Register <- c
+	c.hub.Register(c)
 	go c.writePump()
 	go c.readPump()
 }
 
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.Unregister <- c
+		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(512)
-	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); return nil })
+	c.conn.SetReadLimit(c.hub.cfg.MaxFrameSize)
+	c.conn.SetReadDeadline(time.Now().Add(c.keepalive.PongWait))
+	c.conn.SetPongHandler(c.handlePong)
 	for {
 		_, _, err := c.conn.ReadMessage()
 		if err != nil {
@@ -45,31 +149,195 @@ func (c *Client) readPump() {
 			}
 			break
 		}
+
+		// Once a close was requested keep discarding frames until writePump
+		// has flushed the close frame and torn down the connection
+		if c.closing {
+			continue
+		}
+
+		if !c.allowFrame(time.Now()) {
+			c.hub.metrics.RateLimited(c.hub.frameScope)
+			c.escalate()
+			continue
+		}
 	}
 }
 
+// handlePong extends the read deadline and records the round trip of the
+// ping it answers, whose payload is the time it was sent. Clients may send
+// pongs of their own, so only the echo of the last ping is timed, once.
+func (c *Client) handlePong(payload string) error {
+	now := time.Now()
+	c.conn.SetReadDeadline(now.Add(c.keepalive.PongWait))
+
+	sent, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil || sent == 0 || !c.lastPing.CompareAndSwap(sent, 0) {
+		return nil
+	}
+	if rtt := now.Sub(time.Unix(0, sent)); rtt >= 0 && rtt <= c.keepalive.PongWait {
+		c.stats.pongReceived(rtt)
+		c.hub.rtt.observe(rtt)
+	}
+	return nil
+}
+
+// Stats returns the keepalive figures of the connection
+func (c *Client) Stats() ConnStats {
+	return c.stats.snapshot()
+}
+
+// Keepalive returns the ping/pong timing negotiated for the connection
+func (c *Client) Keepalive() Keepalive {
+	return c.keepalive
+}
+
+// allowFrame counts an inbound frame against the connection and user buckets
+func (c *Client) allowFrame(now time.Time) bool {
+	if !c.connLimiter.AllowN(now, 1) {
+		return false
+	}
+	return c.userLimiter.AllowN(now, 1)
+}
+
+// escalate records a rate limit violation and warns or disconnects the client
+// once it has accumulated enough strikes
+func (c *Client) escalate() {
+	now := time.Now()
+	if now.Sub(c.lastViolation) > c.hub.cfg.StrikeWindow {
+		c.strikes = 0
+	}
+	c.strikes++
+	c.lastViolation = now
+
+	switch {
+	case c.strikes >= c.hub.cfg.CloseAfter:
+		log.Printf("closing connection of user %s: inbound frame rate limit exceeded", c.userID)
+		c.closePolicyViolation("rate limit exceeded")
+	case c.strikes == c.hub.cfg.WarnAfter:
+		c.warn("rate_limited", "sending too fast, frames are being dropped")
+	}
+}
+
+func (c *Client) warn(code, message string) {
+	b, err := json.Marshal(controlFrame{Type: "warning", Code: code, Message: message})
+	if err != nil {
+		return
+	}
+
+	select {
+	case c.control <- outboundFrame{messageType: websocket.TextMessage, data: b}:
+	default:
+	}
+}
+
+// closePolicyViolation queues a close frame behind any pending warning. The
+// read deadline bounds how long we wait for writePump to send it.
+func (c *Client) closePolicyViolation(reason string) {
+	c.closing = true
+	msg := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason)
+
+	select {
+	case c.control <- outboundFrame{messageType: websocket.CloseMessage, data: msg}:
+	case <-time.After(c.keepalive.WriteWait):
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.keepalive.WriteWait))
+}
+
+// writeHello runs before writePump's loop so the hello precedes any
+// message or control frame
+func (c *Client) writeHello() error {
+	b, err := json.Marshal(helloFrame{
+		Type:            "hello",
+		SessionID:       c.session.ID,
+		PingIntervalSec: int(c.keepalive.PingPeriod / time.Second),
+		PongTimeoutSec:  int(c.keepalive.PongWait / time.Second),
+	})
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteWait))
+	c.conn.EnableWriteCompression(false)
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
 func (c *Client) writePump() {
-	ticker := time.NewTicker(54 * time.Second)
+	ticker := time.NewTicker(c.keepalive.PingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+	if err := c.writeHello(); err != nil {
+		return
+	}
 	for {
 		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-c.out.ready:
+			frames, closed := c.out.drain()
+			if err := c.writeFrames(frames); err != nil {
+				return
+			}
+			if closed {
+				msg := []byte{}
+				if m := c.closeMessage.Load(); m != nil {
+					msg = *m
+				}
+				c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteWait))
+				c.conn.WriteMessage(websocket.CloseMessage, msg)
 				return
 			}
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+		case frame := <-c.control:
+			c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteWait))
+			c.conn.EnableWriteCompression(false)
+			if err := c.conn.WriteMessage(frame.messageType, frame.data); err != nil {
+				return
+			}
+			if frame.messageType == websocket.CloseMessage {
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteWait))
+			sent := time.Now().UnixNano()
+			c.lastPing.Store(sent)
+			if err := c.conn.WriteMessage(websocket.PingMessage, []byte(strconv.FormatInt(sent, 10))); err != nil {
 				return
 			}
+			c.stats.pingSent()
+		}
+	}
+}
+
+// writeFrames writes drained outbox frames. With batching, consecutive
+// frames are merged into one WebSocket frame while it stays within
+// WriteBatchMaxBytes, which saves a write syscall per message under load.
+// Only batches reaching CompressionThreshold are compressed.
+func (c *Client) writeFrames(frames [][]byte) error {
+	cfg := c.hub.cfg
+	delimiter := c.codec.Delimiter()
+
+	for len(frames) > 0 {
+		n, size := 1, len(frames[0])
+		for c.batching && n < len(frames) && size+len(delimiter)+len(frames[n]) <= cfg.WriteBatchMaxBytes {
+			size += len(delimiter) + len(frames[n])
+			n++
 		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(c.keepalive.WriteWait))
+		c.conn.EnableWriteCompression(cfg.Compression && size >= cfg.CompressionThreshold)
+		w, err := c.conn.NextWriter(c.codec.MessageType())
+		if err != nil {
+			return err
+		}
+		w.Write(frames[0])
+		for _, frame := range frames[1:n] {
+			w.Write(delimiter)
+			w.Write(frame)
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+
+		frames = frames[n:]
 	}
+	return nil
 }
@@ -1,140 +1,633 @@
 package ws
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"chat-microservice/internal/metrics"
+	"chat-microservice/internal/tracing"
+	"chat-microservice/pkg/models"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
 )
 
+// Hub tracks the subscribers of every user and fans broadcasts out to them.
+//
+// Users are partitioned into shards by a hash of their id. Each shard owns
+// the subscribers of its users and runs its own broadcast workers, so
+// registrations and fan-out for different users rarely contend. Within a
+// shard, subscribers live in a concurrent map of per-user sets, each guarded
+// by its own mutex, and workers push into bounded subscriber queues without
+// ever blocking. Register and Unregister are plain idempotent method calls,
+// so a subscriber can be unregistered any number of times from any
+// goroutine.
+//
+// Each user also has a replay buffer of recent messages, kept for
+// ReplayWindow after their last subscriber leaves, so SSE and long-poll
+// clients can resume where they left off.
 type Hub struct {
-	Register         chan *Client
-	Unregister       chan *Client
-	Broadcast        chan *BroadcastMessage
-	clients          map[string]map[*Client]bool
-	mu               sync.RWMutex
-	broadcastQueue   chan *broadcastJob
-	numBcastWorkers  int
-	numBcastJobQueue int
+	shards   []*shard
+	pending  atomic.Int64
+	done     chan struct{}
+	stopOnce sync.Once
+	cfg      Config
+	rtt      rttHistogram
+	conns    connCounts
+
+	metrics    *metrics.Metrics
+	frameScope string
+}
+
+// connCounts tracks registered subscribers by transport and the users that
+// have at least one
+type connCounts struct {
+	websocket, sse, longPoll atomic.Int64
+	users                    atomic.Int64
+}
+
+func (c *connCounts) forTransport(transport string) *atomic.Int64 {
+	switch transport {
+	case TransportSSE:
+		return &c.sse
+	case TransportLongPoll:
+		return &c.longPoll
+	}
+	return &c.websocket
+}
+
+// ConnectionStats counts the subscribers registered with the hub
+type ConnectionStats struct {
+	// ByTransport counts subscribers per transport
+	ByTransport map[string]int
+	// Users is how many users have at least one subscriber
+	Users int
 }
 
-type broadcastJob struct {
-	client  *Client
-	message []byte
+// ConnectionStats reports how many subscribers and users are connected
+func (h *Hub) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		ByTransport: map[string]int{
+			TransportWebSocket: int(h.conns.websocket.Load()),
+			TransportSSE:       int(h.conns.sse.Load()),
+			TransportLongPoll:  int(h.conns.longPoll.Load()),
+		},
+		Users: int(h.conns.users.Load()),
+	}
+}
+
+type shard struct {
+	hub          *Hub
+	users        sync.Map // userID -> *userConns
+	queue        chan *shardJob
+	userLimiters map[string]*userLimiter
+	limMu        sync.Mutex
+}
+
+// shardJob is the part of a broadcast addressed to the users of one shard.
+// span is the broadcast's, so deliveries join its trace. A job with ack set
+// carries no message; the worker closes ack to show it is alive.
+type shardJob struct {
+	message      *BroadcastMessage
+	participants []string
+	span         trace.SpanContext
+	ack          chan struct{}
+}
+
+// userConns is the set of subscribers of one user along with their replay
+// buffer. Once the last subscriber has been gone for ReplayWindow, the set
+// is marked removed and deleted from the map; registrations racing with that
+// retry with a fresh set.
+type userConns struct {
+	mu          sync.Mutex
+	subscribers map[Subscriber]struct{}
+	removed     bool
+	idleSince   time.Time
+
+	// replay is a ring of the last ReplayBufferSize messages, the oldest at
+	// replayStart; seq numbers the messages of the current epoch
+	epoch       int64
+	seq         uint64
+	replay      []*BroadcastMessage
+	replayStart int
+}
+
+func newUserConns() *userConns {
+	return &userConns{
+		subscribers: make(map[Subscriber]struct{}),
+		epoch:       time.Now().UnixNano(),
+	}
+}
+
+// record appends a message to the replay buffer and returns its event id.
+// It must be called with mu held.
+func (uc *userConns) record(m *BroadcastMessage, size int) EventID {
+	uc.seq++
+	if size > 0 {
+		if len(uc.replay) < size {
+			uc.replay = append(uc.replay, m)
+		} else {
+			uc.replay[uc.replayStart] = m
+			uc.replayStart = (uc.replayStart + 1) % size
+		}
+	}
+	return EventID{Epoch: uc.epoch, Seq: uc.seq}
+}
+
+// since returns the buffered messages after last with their event ids. Ids
+// of another epoch predate the buffer, so everything buffered is returned.
+// It must be called with mu held.
+func (uc *userConns) since(last EventID) ([]*BroadcastMessage, []EventID) {
+	n := uint64(len(uc.replay))
+	first := uc.seq - n + 1
+	skip := uint64(0)
+	if last.Epoch == uc.epoch && last.Seq >= first {
+		skip = last.Seq - first + 1
+	}
+	if skip >= n {
+		return nil, nil
+	}
+
+	messages := make([]*BroadcastMessage, 0, n-skip)
+	ids := make([]EventID, 0, n-skip)
+	for i := skip; i < n; i++ {
+		messages = append(messages, uc.replay[(uc.replayStart+int(i))%len(uc.replay)])
+		ids = append(ids, EventID{Epoch: uc.epoch, Seq: first + i})
+	}
+	return messages, ids
+}
+
+// userLimiter is the inbound frame bucket shared by all connections of a user
+type userLimiter struct {
+	limiter *rate.Limiter
+	refs    int
 }
 
 type BroadcastMessage struct {
 	Participants []string
-	Message      []byte
+	Message      *models.Message
 	SenderID     string
+	// OriginSessionID is the sender's session the message was sent from. The
+	// sender's other sessions get the message too so all their devices stay
+	// in sync; when empty, all of them do.
+	OriginSessionID string
+
+	// encoded caches the frame of every codec the message was delivered
+	// with, so it is encoded once per encoding rather than once per client
+	encMu   sync.Mutex
+	encoded map[Codec][]byte
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		Register:         make(chan *Client),
-		Unregister:       make(chan *Client),
-		Broadcast:        make(chan *BroadcastMessage),
-		clients:          make(map[string]map[*Client]bool),
-		broadcastQueue:   make(chan *broadcastJob, 1024),
-		numBcastWorkers:  4,
-		numBcastJobQueue: 1024,
+// isOrigin reports whether sub is the session the message was sent from,
+// which already has it
+func (b *BroadcastMessage) isOrigin(sub Subscriber) bool {
+	return b.OriginSessionID != "" && sub.UserID() == b.SenderID && sub.Session().ID == b.OriginSessionID
+}
+
+// frame returns the message encoded with codec, encoding it on first use
+func (b *BroadcastMessage) frame(codec Codec) ([]byte, error) {
+	b.encMu.Lock()
+	defer b.encMu.Unlock()
+
+	if frame, ok := b.encoded[codec]; ok {
+		return frame, nil
+	}
+	frame, err := codec.Encode(b.Message)
+	if err != nil {
+		return nil, err
+	}
+	if b.encoded == nil {
+		b.encoded = make(map[Codec][]byte, len(codecs))
+	}
+	b.encoded[codec] = frame
+	return frame, nil
+}
+
+func NewHub(cfg Config) *Hub {
+	if cfg.Shards < 1 {
+		cfg.Shards = 1
+	}
+	if cfg.WorkersPerShard < 1 {
+		cfg.WorkersPerShard = 1
 	}
+
+	h := &Hub{
+		shards: make([]*shard, cfg.Shards),
+		done:   make(chan struct{}),
+		cfg:    cfg,
+	}
+	for i := range h.shards {
+		h.shards[i] = &shard{
+			hub:          h,
+			queue:        make(chan *shardJob, cfg.ShardQueueSize),
+			userLimiters: make(map[string]*userLimiter),
+		}
+	}
+	return h
 }
 
+// Run starts the broadcast workers of every shard and blocks until Stop is
+// called
 func (h *Hub) Run() {
-	for i := 0; i < h.numBcastWorkers; i++ {
-		go h.broadcastWorker()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.evictIdleUsers()
+	}()
+	for _, s := range h.shards {
+		for i := 0; i < h.cfg.WorkersPerShard; i++ {
+			wg.Add(1)
+			go func(s *shard) {
+				defer wg.Done()
+				s.broadcastWorker()
+			}(s)
+		}
 	}
 
-	for {
+	<-h.done
+	wg.Wait()
+}
+
+// Stop terminates the broadcast workers. Broadcasts issued afterwards are
+// discarded.
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.done) })
+}
+
+func (h *Hub) shardFor(userID string) *shard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	f := fnv.New32a()
+	f.Write([]byte(userID))
+	return h.shards[f.Sum32()%uint32(len(h.shards))]
+}
+
+// Broadcast splits a message by the shards of its participants and queues
+// one job per shard. It only waits for room in the shard queues, never on
+// clients.
+func (h *Hub) Broadcast(broadcastMessage *BroadcastMessage) {
+	h.BroadcastContext(context.Background(), broadcastMessage)
+}
+
+// BroadcastContext is Broadcast giving up once ctx is done. Jobs queued
+// before that are still delivered, so participants in other shards may have
+// received the message when it returns ctx's error.
+func (h *Hub) BroadcastContext(ctx context.Context, broadcastMessage *BroadcastMessage) (err error) {
+	byShard := make(map[*shard][]string)
+	for _, participantID := range broadcastMessage.Participants {
+		s := h.shardFor(participantID)
+		byShard[s] = append(byShard[s], participantID)
+	}
+
+	ctx, span := tracing.Start(ctx, "hub.Broadcast", trace.WithAttributes(
+		attribute.Int("chat.participants", len(broadcastMessage.Participants)),
+		attribute.Int("chat.shards", len(byShard)),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	for s, participants := range byShard {
+		h.pending.Add(1)
 		select {
-		case client := <-h.Register:
-			h.registerClient(client)
-		case client := <-h.Unregister:
-			h.unregisterClient(client)
-		case broadcastMessage := <-h.Broadcast:
-			h.broadcastMessage(broadcastMessage)
+		case s.queue <- &shardJob{message: broadcastMessage, participants: participants, span: span.SpanContext()}:
+		case <-h.done:
+			h.pending.Add(-1)
+			return nil
+		case <-ctx.Done():
+			h.pending.Add(-1)
+			return ctx.Err()
 		}
 	}
+	return nil
 }
 
-func (h *Hub) broadcastWorker() {
-	for job := range h.broadcastQueue {
+// Ping queues a no-op job on every shard and waits until a worker has taken
+// each of them, so it fails if workers are stuck or queues don't drain
+// before ctx is done
+func (h *Hub) Ping(ctx context.Context) error {
+	acks := make([]chan struct{}, len(h.shards))
+	for i, s := range h.shards {
+		acks[i] = make(chan struct{})
+		select {
+		case s.queue <- &shardJob{ack: acks[i]}:
+		case <-h.done:
+			return errHubStopped
+		case <-ctx.Done():
+			return fmt.Errorf("shard %d queue full: %w", i, ctx.Err())
+		}
+	}
+	for i, ack := range acks {
 		select {
-		case job.client.send <- job.message:
-		default:
+		case <-ack:
+		case <-h.done:
+			return errHubStopped
+		case <-ctx.Done():
+			return fmt.Errorf("shard %d not draining: %w", i, ctx.Err())
+		}
+	}
+	return nil
+}
+
+var errHubStopped = errors.New("hub stopped")
 
-			h.Unregister <- job.client
+// Config returns the configuration the hub was created with
+func (h *Hub) Config() Config {
+	return h.cfg
+}
+
+// SetMetrics counts the WebSocket frames dropped by the inbound frame rate
+// limits under the given scope, e.g. "ws_frame". It must be called before
+// clients connect.
+func (h *Hub) SetMetrics(m *metrics.Metrics, scope string) {
+	h.metrics = m
+	h.frameScope = scope
+}
+
+// RTTStats returns the ping round trips of all connections so far
+func (h *Hub) RTTStats() RTTStats {
+	return h.rtt.stats()
+}
+
+// QueueDepth returns the number of shard jobs queued or being delivered
+func (h *Hub) QueueDepth() int {
+	return int(h.pending.Load())
+}
+
+func (s *shard) broadcastWorker() {
+	for {
+		select {
+		case job := <-s.queue:
+			if job.ack != nil {
+				close(job.ack)
+				continue
+			}
+			s.deliverJob(job)
+			s.hub.pending.Add(-1)
+		case <-s.hub.done:
+			return
 		}
 	}
 }
 
-func (h *Hub) registerClient(client *Client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+// deliverJob records a span for every subscriber the message is pushed to,
+// as a child of the broadcast that queued the job
+func (s *shard) deliverJob(job *shardJob) {
+	recipients := s.recipients(job.message, job.participants)
 
-	if _, ok := h.clients[client.userID]; !ok {
-		h.clients[client.userID] = make(map[*Client]bool)
+	ctx := trace.ContextWithSpanContext(context.Background(), job.span)
+	now := time.Now()
+	for _, r := range recipients {
+		sub := r.subscriber
+		_, span := tracing.Start(ctx, "hub.deliver", trace.WithAttributes(
+			attribute.String("chat.user_id", sub.UserID()),
+			attribute.String("chat.session_id", sub.Session().ID),
+			attribute.String("chat.transport", sub.Session().Transport),
+			attribute.String("chat.event_id", r.id.String()),
+		))
+		tracing.End(span, s.hub.deliver(sub, r.id, job.message, now))
 	}
-	h.clients[client.userID][client] = true
-	log.Printf("client registered for user %s, total connections for user=%d", client.userID, len(h.clients[client.userID]))
 }
 
-func (h *Hub) unregisterClient(client *Client) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+type recipient struct {
+	subscriber Subscriber
+	id         EventID
+}
 
-	if userClients, ok := h.clients[client.userID]; ok {
-		if _, exists := userClients[client]; exists {
-			delete(userClients, client)
-			close(client.send)
-			log.Printf("client unregistered from user %s, total connections for user=%d", client.userID, len(userClients))
-			if len(userClients) == 0 {
-				delete(h.clients, client.userID)
+// recipients records the message in the replay buffers of the participants
+// the hub tracks and snapshots their subscribers, so delivery happens
+// without holding any lock. Recording and snapshotting under the same lock
+// as registration means a subscriber resuming concurrently gets each
+// message exactly once, either replayed or delivered.
+func (s *shard) recipients(m *BroadcastMessage, participants []string) []recipient {
+	var recipients []recipient
+	for _, participantID := range participants {
+		v, ok := s.users.Load(participantID)
+		if !ok {
+			continue
+		}
+		uc := v.(*userConns)
+
+		uc.mu.Lock()
+		if !uc.removed {
+			id := uc.record(m, s.hub.cfg.ReplayBufferSize)
+			for sub := range uc.subscribers {
+				if m.isOrigin(sub) {
+					continue
+				}
+				recipients = append(recipients, recipient{subscriber: sub, id: id})
 			}
 		}
+		uc.mu.Unlock()
 	}
+	return recipients
 }
 
-func (h *Hub) broadcastMessage(broadcastMessage *BroadcastMessage) {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+func (s *shard) acquireUserLimiter(userID string) *rate.Limiter {
+	s.limMu.Lock()
+	defer s.limMu.Unlock()
 
-	for _, participantID := range broadcastMessage.Participants {
-		if participantID == broadcastMessage.SenderID {
-			continue
+	ul, ok := s.userLimiters[userID]
+	if !ok {
+		ul = &userLimiter{limiter: rate.NewLimiter(s.hub.cfg.UserFrameRate, s.hub.cfg.UserFrameBurst)}
+		s.userLimiters[userID] = ul
+	}
+	ul.refs++
+	return ul.limiter
+}
+
+func (s *shard) releaseUserLimiter(userID string) {
+	s.limMu.Lock()
+	defer s.limMu.Unlock()
+
+	if ul, ok := s.userLimiters[userID]; ok {
+		ul.refs--
+		if ul.refs <= 0 {
+			delete(s.userLimiters, userID)
 		}
+	}
+}
+
+// Register adds a subscriber to its user's subscribers. Registering the
+// same subscriber twice has no effect.
+func (h *Hub) Register(sub Subscriber) {
+	h.RegisterFrom(sub, EventID{})
+}
 
-		if userClients, ok := h.clients[participantID]; ok {
-			for client := range userClients {
-				h.broadcastQueue <- &broadcastJob{
-					client:  client,
-					message: broadcastMessage.Message,
+// RegisterFrom registers a subscriber and first pushes it the buffered
+// messages after last, so a reconnecting client resumes without gaps as
+// long as it is back within the replay window. A zero last replays nothing.
+// It returns the id of the user's latest message, which is where the
+// subscriber's stream starts when nothing is replayed.
+func (h *Hub) RegisterFrom(sub Subscriber, last EventID) EventID {
+	userID := sub.UserID()
+	s := h.shardFor(userID)
+	for {
+		v, ok := s.users.Load(userID)
+		if !ok {
+			v, _ = s.users.LoadOrStore(userID, newUserConns())
+		}
+		uc := v.(*userConns)
+
+		uc.mu.Lock()
+		if uc.removed {
+			uc.mu.Unlock()
+			continue
+		}
+		cursor := EventID{Epoch: uc.epoch, Seq: uc.seq}
+		if _, exists := uc.subscribers[sub]; exists {
+			uc.mu.Unlock()
+			return cursor
+		}
+		uc.subscribers[sub] = struct{}{}
+		h.conns.forTransport(sub.Session().Transport).Add(1)
+		if len(uc.subscribers) == 1 {
+			h.conns.users.Add(1)
+		}
+		if client, ok := sub.(*Client); ok {
+			client.userLimiter = s.acquireUserLimiter(userID)
+		}
+		if !last.IsZero() {
+			messages, ids := uc.since(last)
+			now := time.Now()
+			for i, m := range messages {
+				if frame, err := m.frame(sub.Codec()); err == nil {
+					sub.Push(ids[i], frame, now)
 				}
 			}
 		}
+		total := len(uc.subscribers)
+		uc.mu.Unlock()
+
+		if h.cfg.LogConnections {
+			log.Printf("client registered for user %s, total connections for user=%d", userID, total)
+		}
+		return cursor
 	}
 }
 
-func (h *Hub) GetUserConnectionCount(userID string) int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// Unregister removes a subscriber and closes it; a client's writePump then
+// shuts the connection down. It is safe to call more than once.
+func (h *Hub) Unregister(sub Subscriber) {
+	userID := sub.UserID()
+	s := h.shardFor(userID)
+	v, ok := s.users.Load(userID)
+	if !ok {
+		return
+	}
+	uc := v.(*userConns)
 
-	if userClients, ok := h.clients[userID]; ok {
-		return len(userClients)
+	uc.mu.Lock()
+	if _, exists := uc.subscribers[sub]; !exists {
+		uc.mu.Unlock()
+		return
+	}
+	delete(uc.subscribers, sub)
+	h.conns.forTransport(sub.Session().Transport).Add(-1)
+	total := len(uc.subscribers)
+	if total == 0 {
+		h.conns.users.Add(-1)
+		uc.idleSince = time.Now()
+		if h.cfg.ReplayBufferSize <= 0 {
+			uc.removed = true
+			s.users.CompareAndDelete(userID, uc)
+		}
+	}
+	uc.mu.Unlock()
+
+	sub.Close()
+	if _, ok := sub.(*Client); ok {
+		s.releaseUserLimiter(userID)
+	}
+	if h.cfg.LogConnections {
+		log.Printf("client unregistered from user %s, total connections for user=%d", userID, total)
 	}
-	return 0
 }
 
-func (h *Hub) GetChannelParticipantCounts(participants []string) map[string]int {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+// evictIdleUsers forgets the replay buffers of users that have had no
+// subscribers for longer than ReplayWindow
+func (h *Hub) evictIdleUsers() {
+	if h.cfg.ReplayBufferSize <= 0 {
+		return
+	}
+
+	interval := h.cfg.ReplayWindow / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, s := range h.shards {
+				s.users.Range(func(key, v any) bool {
+					uc := v.(*userConns)
+					uc.mu.Lock()
+					if len(uc.subscribers) == 0 && now.Sub(uc.idleSince) > h.cfg.ReplayWindow {
+						uc.removed = true
+						s.users.CompareAndDelete(key, uc)
+					}
+					uc.mu.Unlock()
+					return true
+				})
+			}
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// errSlowSubscriber is reported for a subscriber dropped because its queue
+// was full
+var errSlowSubscriber = errors.New("subscriber queue full, unregistered")
+
+// deliver encodes a message for a subscriber and queues it without
+// blocking. Subscribers that can't keep up are unregistered, which closes
+// their connection or stream.
+func (h *Hub) deliver(sub Subscriber, id EventID, m *BroadcastMessage, now time.Time) error {
+	frame, err := m.frame(sub.Codec())
+	if err != nil {
+		log.Printf("failed to encode message as %s: %v", sub.Codec().Subprotocol(), err)
+		return err
+	}
+	if sub.Push(id, frame, now) {
+		return nil
+	}
+
+	if client, ok := sub.(*Client); ok {
+		log.Printf("disconnecting slow client of user %s after dropping %d frames", client.userID, client.out.droppedFrames())
+	} else {
+		log.Printf("closing stream of user %s: event queue full", sub.UserID())
+	}
+	h.Unregister(sub)
+	return errSlowSubscriber
+}
 
+func (h *Hub) GetUserConnectionCount(userID string) int {
+	v, ok := h.shardFor(userID).users.Load(userID)
+	if !ok {
+		return 0
+	}
+	uc := v.(*userConns)
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return len(uc.subscribers)
+}
+
+func (h *Hub) GetChannelParticipantCounts(participants []string) map[string]int {
 	counts := make(map[string]int)
 	for _, userID := range participants {
-		if userClients, ok := h.clients[userID]; ok {
-			counts[userID] = len(userClients)
-		} else {
-			counts[userID] = 0
-		}
+		counts[userID] = h.GetUserConnectionCount(userID)
 	}
 	return counts
 }
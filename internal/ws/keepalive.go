@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keepalive is the ping/pong timing of one connection. The server pings
+// every PingPeriod and drops the connection when nothing, pongs included,
+// has been read for PongWait. WriteWait bounds every write.
+type Keepalive struct {
+	PingPeriod time.Duration
+	PongWait   time.Duration
+	WriteWait  time.Duration
+}
+
+// Keepalive returns the timing used for connections that don't ask for
+// their own
+func (cfg Config) Keepalive() Keepalive {
+	return Keepalive{
+		PingPeriod: cfg.PingPeriod,
+		PongWait:   cfg.PongWait,
+		WriteWait:  cfg.WriteWait,
+	}
+}
+
+// NegotiateKeepalive applies the ping interval and pong timeout a client
+// asked for at handshake. The ping interval is clamped to
+// [MinPingPeriod, MaxPingPeriod] and the pong timeout to at most twice
+// MaxPingPeriod. A pong timeout that wouldn't outlast the next ping is
+// replaced by one with the configured ratio to the ping interval, as is a
+// missing one when only the interval was given. Zero values keep the
+// defaults.
+func NegotiateKeepalive(cfg Config, pingPeriod, pongWait time.Duration) Keepalive {
+	k := cfg.Keepalive()
+	if pingPeriod > 0 {
+		k.PingPeriod = min(max(pingPeriod, cfg.MinPingPeriod), cfg.MaxPingPeriod)
+	}
+
+	switch {
+	case pongWait > k.PingPeriod:
+		k.PongWait = min(pongWait, 2*cfg.MaxPingPeriod)
+	case pingPeriod > 0 || pongWait > 0:
+		k.PongWait = time.Duration(float64(k.PingPeriod) * float64(cfg.PongWait) / float64(cfg.PingPeriod))
+	}
+	return k
+}
+
+// rttBuckets are the upper bounds of the ping round-trip time histogram
+var rttBuckets = []time.Duration{
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+}
+
+// rttHistogram aggregates ping round trips of all connections of a hub
+type rttHistogram struct {
+	counts [10]atomic.Uint64 // one per bucket plus +Inf
+	sum    atomic.Int64
+	total  atomic.Uint64
+}
+
+func (h *rttHistogram) observe(rtt time.Duration) {
+	i := 0
+	for i < len(rttBuckets) && rtt > rttBuckets[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(rtt))
+	h.total.Add(1)
+}
+
+// RTTBucket counts the pongs that arrived within LE milliseconds of their
+// ping; counts are cumulative and the last bucket has no bound
+type RTTBucket struct {
+	LE    string `json:"le"`
+	Count uint64 `json:"count"`
+}
+
+// RTTStats summarizes ping round trips since the hub started
+type RTTStats struct {
+	Pongs   uint64      `json:"pongs"`
+	MeanMs  float64     `json:"mean_ms"`
+	Buckets []RTTBucket `json:"buckets"`
+}
+
+func (h *rttHistogram) stats() RTTStats {
+	stats := RTTStats{Pongs: h.total.Load()}
+	if stats.Pongs > 0 {
+		stats.MeanMs = float64(h.sum.Load()) / float64(stats.Pongs) / float64(time.Millisecond)
+	}
+
+	var cumulative uint64
+	for i := range h.counts {
+		cumulative += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(rttBuckets) {
+			le = strconv.FormatInt(rttBuckets[i].Milliseconds(), 10)
+		}
+		stats.Buckets = append(stats.Buckets, RTTBucket{LE: le, Count: cumulative})
+	}
+	return stats
+}
+
+// ConnStats are the keepalive figures of one connection
+type ConnStats struct {
+	PingsSent     uint64
+	PongsReceived uint64
+	LastRTT       time.Duration
+	SmoothedRTT   time.Duration
+	MinRTT        time.Duration
+	MaxRTT        time.Duration
+}
+
+// connStats is updated by writePump when pinging and by readPump when a
+// pong arrives
+type connStats struct {
+	mu sync.Mutex
+	ConnStats
+}
+
+func (s *connStats) pingSent() {
+	s.mu.Lock()
+	s.PingsSent++
+	s.mu.Unlock()
+}
+
+// pongReceived records a round trip; the smoothed RTT is an exponentially
+// weighted moving average like TCP's SRTT
+func (s *connStats) pongReceived(rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.PongsReceived++
+	s.LastRTT = rtt
+	if s.PongsReceived == 1 {
+		s.SmoothedRTT, s.MinRTT, s.MaxRTT = rtt, rtt, rtt
+		return
+	}
+	s.SmoothedRTT += (rtt - s.SmoothedRTT) / 8
+	s.MinRTT = min(s.MinRTT, rtt)
+	s.MaxRTT = max(s.MaxRTT, rtt)
+}
+
+func (s *connStats) snapshot() ConnStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ConnStats
+}
@@ -0,0 +1,154 @@
+package ws
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// OverflowPolicy decides what happens when a client's outbound queue is full
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest queued frame to make room
+	DropOldest OverflowPolicy = iota
+	// Coalesce merges the frame into the newest queued one, using the
+	// client's codec to keep both decodable (newline separated for JSON), and
+	// falls back to DropOldest once that frame reaches CoalesceMaxBytes
+	Coalesce
+	// Disconnect drops new frames while the queue stays full and disconnects
+	// the client once it has been full for longer than the grace period
+	Disconnect
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch s {
+	case "drop_oldest":
+		return DropOldest, nil
+	case "coalesce":
+		return Coalesce, nil
+	case "disconnect":
+		return Disconnect, nil
+	}
+	return DropOldest, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case Coalesce:
+		return "coalesce"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "drop_oldest"
+}
+
+// outbox is a bounded queue of frames waiting for a client's writePump.
+// Pushing never blocks, so a slow client can't stall whoever is delivering
+// to it; the overflow policy decides how it sheds load instead.
+type outbox struct {
+	mu          sync.Mutex
+	frames      [][]byte
+	capacity    int
+	policy      OverflowPolicy
+	grace       time.Duration
+	maxCoalesce int
+	delimiter   []byte
+	fullSince   time.Time
+	dropped     uint64
+	closed      bool
+
+	// ready has a buffer of one and is signalled whenever frames are queued
+	// or the outbox is closed
+	ready chan struct{}
+}
+
+func newOutbox(cfg Config, codec Codec) *outbox {
+	return &outbox{
+		frames:      make([][]byte, 0, cfg.SendQueueSize),
+		capacity:    cfg.SendQueueSize,
+		policy:      cfg.OverflowPolicy,
+		grace:       cfg.OverflowGrace,
+		maxCoalesce: cfg.CoalesceMaxBytes,
+		delimiter:   codec.Delimiter(),
+		ready:       make(chan struct{}, 1),
+	}
+}
+
+// push queues a frame. It returns false when the client has been over
+// capacity for longer than the grace period and should be disconnected.
+// Pushing to a closed outbox is a no-op.
+func (o *outbox) push(frame []byte, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return true
+	}
+
+	if len(o.frames) < o.capacity {
+		o.frames = append(o.frames, frame)
+		o.signal()
+		return true
+	}
+
+	switch o.policy {
+	case Disconnect:
+		o.dropped++
+		if o.fullSince.IsZero() {
+			o.fullSince = now
+		}
+		return now.Sub(o.fullSince) <= o.grace
+	case Coalesce:
+		last := len(o.frames) - 1
+		if len(o.frames[last])+len(o.delimiter)+len(frame) <= o.maxCoalesce {
+			merged := make([]byte, 0, len(o.frames[last])+len(o.delimiter)+len(frame))
+			merged = append(merged, o.frames[last]...)
+			merged = append(merged, o.delimiter...)
+			o.frames[last] = append(merged, frame...)
+			return true
+		}
+	}
+
+	o.dropped++
+	o.frames[0] = nil
+	o.frames = append(o.frames[1:], frame)
+	o.signal()
+	return true
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drain removes and returns every queued frame, and reports whether the
+// outbox has been closed
+func (o *outbox) drain() ([][]byte, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	frames := o.frames
+	o.frames = make([][]byte, 0, o.capacity)
+	o.fullSince = time.Time{}
+	return frames, o.closed
+}
+
+// close makes the writer flush what is queued and then shut the connection
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.closed {
+		o.closed = true
+		o.signal()
+	}
+}
+
+func (o *outbox) droppedFrames() uint64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.dropped
+}
@@ -0,0 +1,95 @@
+package ws
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transports a session can be connected through
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportLongPoll  = "long_poll"
+)
+
+// CloseSessionTerminated is the WebSocket close code sent to a connection
+// that was ended from another device. Clients shouldn't reconnect on it.
+const CloseSessionTerminated = 4001
+
+// Session describes one subscriber of a user: one device or browser tab
+type Session struct {
+	// ID is assigned by the server and unique per connection
+	ID string `json:"id"`
+	// DeviceID is an optional identifier the client sends at handshake so
+	// the user can tell their devices apart
+	DeviceID    string    `json:"device_id,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Transport   string    `json:"transport"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// newSession fills in the server-assigned fields
+func newSession(s Session, transport string) Session {
+	if s.ID == "" {
+		s.ID = NewSessionID()
+	}
+	if s.Transport == "" {
+		s.Transport = transport
+	}
+	if s.ConnectedAt.IsZero() {
+		s.ConnectedAt = time.Now().UTC()
+	}
+	return s
+}
+
+// NewSessionID returns a random id for a session
+func NewSessionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// ValidSessionID reports whether id has the form NewSessionID returns
+func ValidSessionID(id string) bool {
+	if len(id) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Subscribers returns the current subscribers of a user
+func (h *Hub) Subscribers(userID string) []Subscriber {
+	v, ok := h.shardFor(userID).users.Load(userID)
+	if !ok {
+		return nil
+	}
+	uc := v.(*userConns)
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	subs := make([]Subscriber, 0, len(uc.subscribers))
+	for sub := range uc.subscribers {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// Terminate disconnects one session of a user and reports whether it was
+// found. WebSocket clients are closed with CloseSessionTerminated.
+func (h *Hub) Terminate(userID, sessionID string) bool {
+	for _, sub := range h.Subscribers(userID) {
+		if sub.Session().ID != sessionID {
+			continue
+		}
+		if client, ok := sub.(*Client); ok {
+			client.setCloseMessage(websocket.FormatCloseMessage(CloseSessionTerminated, "session terminated"))
+		}
+		h.Unregister(sub)
+		return true
+	}
+	return false
+}
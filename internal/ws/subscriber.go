@@ -0,0 +1,150 @@
+package ws
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscriber receives the broadcasts addressed to one user. Client is the
+// WebSocket implementation; Stream backs the SSE and long-poll transports.
+type Subscriber interface {
+	UserID() string
+	Session() Session
+	// Codec encodes the messages pushed to the subscriber
+	Codec() Codec
+	// Push queues an encoded message without blocking. It returns false when
+	// the subscriber can't keep up and should be unregistered.
+	Push(id EventID, frame []byte, now time.Time) bool
+	// Close is called once when the hub unregisters the subscriber
+	Close()
+}
+
+// EventID identifies a message in the replay buffer of a user. Seq counts
+// the messages delivered to the user; Epoch changes whenever the hub starts
+// tracking the user afresh, e.g. after a restart, so ids of an earlier epoch
+// can't be mistaken for current ones.
+type EventID struct {
+	Epoch int64
+	Seq   uint64
+}
+
+func (id EventID) IsZero() bool {
+	return id == EventID{}
+}
+
+// String formats the id as "<epoch>-<seq>" in base 36, as sent in SSE id
+// fields and long-poll cursors
+func (id EventID) String() string {
+	if id.IsZero() {
+		return ""
+	}
+	return strconv.FormatInt(id.Epoch, 36) + "-" + strconv.FormatUint(id.Seq, 36)
+}
+
+func ParseEventID(s string) (EventID, error) {
+	if s == "" {
+		return EventID{}, nil
+	}
+	epoch, seq, ok := strings.Cut(s, "-")
+	if !ok {
+		return EventID{}, fmt.Errorf("invalid event id %q", s)
+	}
+	e, err := strconv.ParseInt(epoch, 36, 64)
+	if err != nil {
+		return EventID{}, fmt.Errorf("invalid event id %q", s)
+	}
+	n, err := strconv.ParseUint(seq, 36, 64)
+	if err != nil {
+		return EventID{}, fmt.Errorf("invalid event id %q", s)
+	}
+	return EventID{Epoch: e, Seq: n}, nil
+}
+
+// Event is a message queued for a Stream
+type Event struct {
+	ID   EventID
+	Data []byte
+}
+
+// Stream is a Subscriber for HTTP transports that hold a request open
+// rather than a connection. Messages are JSON encoded and queued in a
+// bounded buffer; when it overflows the hub unregisters the stream, and the
+// client is expected to reconnect and resume from its last event id.
+type Stream struct {
+	userID   string
+	session  Session
+	mu       sync.Mutex
+	events   []Event
+	capacity int
+	closed   bool
+
+	// ready has a buffer of one and is signalled whenever events are queued
+	// or the stream is closed
+	ready chan struct{}
+}
+
+// NewStream creates a stream for a user. The session's ID and ConnectedAt
+// are filled in when empty; Transport defaults to SSE.
+func NewStream(userID string, capacity int, session Session) *Stream {
+	return &Stream{
+		userID:   userID,
+		session:  newSession(session, TransportSSE),
+		capacity: capacity,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func (s *Stream) UserID() string   { return s.userID }
+func (s *Stream) Session() Session { return s.session }
+func (s *Stream) Codec() Codec     { return JSONCodec }
+
+func (s *Stream) Push(id EventID, frame []byte, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return true
+	}
+	if len(s.events) >= s.capacity {
+		return false
+	}
+	s.events = append(s.events, Event{ID: id, Data: frame})
+	s.signal()
+	return true
+}
+
+func (s *Stream) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		s.signal()
+	}
+}
+
+func (s *Stream) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is signalled when Drain has something to return
+func (s *Stream) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Drain removes and returns the queued events, and reports whether the
+// stream has been closed
+func (s *Stream) Drain() ([]Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := s.events
+	s.events = nil
+	return events, s.closed
+}
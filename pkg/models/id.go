@@ -0,0 +1,71 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// crockford is the Base32 alphabet of ULIDs
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var ulidState struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+// NewID returns a ULID: 48 bits of milliseconds since the epoch followed by
+// 80 random bits, as 26 Crockford Base32 characters. IDs generated within
+// the same millisecond increment the random part, so they sort in the order
+// they were generated.
+func NewID() string {
+	return newID(time.Now())
+}
+
+func newID(now time.Time) string {
+	ms := uint64(now.UnixMilli())
+
+	ulidState.mu.Lock()
+	if ms <= ulidState.lastMs {
+		ms = ulidState.lastMs
+		incrementEntropy(&ulidState.entropy)
+	} else {
+		ulidState.lastMs = ms
+		rand.Read(ulidState.entropy[:])
+	}
+	var id [16]byte
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	copy(id[6:], ulidState.entropy[:])
+	ulidState.mu.Unlock()
+
+	return encodeULID(id)
+}
+
+// incrementEntropy adds one to the big-endian random part. Overflowing 80
+// bits within a millisecond is not a practical concern.
+func incrementEntropy(e *[10]byte) {
+	for i := len(e) - 1; i >= 0; i-- {
+		e[i]++
+		if e[i] != 0 {
+			return
+		}
+	}
+}
+
+// encodeULID writes the 128 bits as 26 characters of 5 bits each, the first
+// one holding only the 3 most significant bits
+func encodeULID(id [16]byte) string {
+	hi := binary.BigEndian.Uint64(id[0:8])
+	lo := binary.BigEndian.Uint64(id[8:16])
+
+	var out [26]byte
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&0x1f]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
@@ -7,11 +7,30 @@ import (
 )
 
 type Message struct {
-	ID           string    `json:"id,omitempty" bson:"_id,omitempty"`
+	ID           string    `json:"id,omitempty" bson:"_id,omitempty"` // ULID assigned when the message is accepted
+	ClientMsgID  string    `json:"client_msg_id,omitempty" bson:"client_msg_id,omitempty"`
+	Seq          uint64    `json:"seq,omitempty" bson:"seq,omitempty"` // Position in the channel, starting at 1
 	Sender       string    `json:"sender" bson:"sender"`
 	Content      string    `json:"content" bson:"content"`
 	CreatedAt    time.Time `json:"created_at" bson:"created_at"`
 	Participants []string  `json:"participants" bson:"participants"` // Sorted array of user IDs
+	// DuplicateOf marks a placeholder: the id of the message a retried send
+	// repeated, stored in its place to keep its sequence number
+	DuplicateOf string `json:"duplicate_of,omitempty" bson:"duplicate_of,omitempty"`
+}
+
+// Placeholder returns the document stored instead of m when m turns out to
+// repeat the message with id originalID. It keeps m's id and sequence
+// number but no content or client_msg_id.
+func (m *Message) Placeholder(originalID string) *Message {
+	return &Message{
+		ID:           m.ID,
+		Seq:          m.Seq,
+		Sender:       m.Sender,
+		CreatedAt:    m.CreatedAt,
+		Participants: m.Participants,
+		DuplicateOf:  originalID,
+	}
 }
 
 // GetChannelID returns a consistent string representation of the channel
@@ -0,0 +1,110 @@
+package test
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+	"time"
+
+	"chat-microservice/internal/ws"
+	"chat-microservice/pkg/models"
+)
+
+// benchConnections simulated clients are spread over half as many users, so
+// every user has two devices connected
+const (
+	benchConnections = 100000
+	benchGroupSize   = 10
+)
+
+func newBenchHub(b *testing.B, shards, workers int) (*ws.Hub, []string) {
+	cfg := ws.DefaultConfig()
+	cfg.Shards = shards
+	cfg.WorkersPerShard = workers
+	cfg.LogConnections = false
+	cfg.SendQueueSize = 16
+
+	hub := ws.NewHub(cfg)
+	go hub.Run()
+	b.Cleanup(hub.Stop)
+
+	users := make([]string, benchConnections/2)
+	for i := range users {
+		users[i] = fmt.Sprintf("bench-%d", i)
+		for d := 0; d < 2; d++ {
+			// Clients without a connection never drain their outbox, so the
+			// overflow policy is exercised as well
+			hub.Register(ws.NewClient(nil, hub, users[i]))
+		}
+	}
+	return hub, users
+}
+
+func waitDrained(hub *ws.Hub) {
+	for hub.QueueDepth() > 0 {
+		runtime.Gosched()
+	}
+}
+
+var benchShardings = []struct {
+	shards  int
+	workers int
+}{
+	{1, 1},
+	{4, 1},
+	{16, 1},
+	{16, 4},
+	{64, 1},
+}
+
+// BenchmarkHubBroadcast measures fan-out of group messages to random users
+// of a hub holding 100k connections
+func BenchmarkHubBroadcast(b *testing.B) {
+	for _, tc := range benchShardings {
+		b.Run(fmt.Sprintf("shards=%d/workers=%d", tc.shards, tc.workers), func(b *testing.B) {
+			hub, users := newBenchHub(b, tc.shards, tc.workers)
+			message := &models.Message{Content: "bench"}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					participants := make([]string, benchGroupSize)
+					for i := range participants {
+						participants[i] = users[r.Intn(len(users))]
+					}
+					hub.Broadcast(&ws.BroadcastMessage{Participants: participants, Message: message, SenderID: participants[0]})
+				}
+			})
+			waitDrained(hub)
+			b.StopTimer()
+
+			// Every participant has two devices; the sender's get the echo
+			deliveries := float64(b.N) * benchGroupSize * 2
+			b.ReportMetric(deliveries/b.Elapsed().Seconds(), "deliveries/s")
+		})
+	}
+}
+
+// BenchmarkHubRegisterUnregister measures connection churn on a hub that
+// already holds 100k connections
+func BenchmarkHubRegisterUnregister(b *testing.B) {
+	for _, tc := range benchShardings {
+		b.Run(fmt.Sprintf("shards=%d/workers=%d", tc.shards, tc.workers), func(b *testing.B) {
+			hub, users := newBenchHub(b, tc.shards, tc.workers)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(time.Now().UnixNano()))
+				for pb.Next() {
+					client := ws.NewClient(nil, hub, users[r.Intn(len(users))])
+					hub.Register(client)
+					hub.Unregister(client)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,298 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat-microservice/internal/httpapi"
+	"chat-microservice/internal/middleware"
+	"chat-microservice/internal/service"
+	"chat-microservice/internal/ws"
+	"chat-microservice/pkg/models"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The stress tests are meant to be run with the race detector:
+//
+//	go test -race ./test -run TestStress
+
+const stressTimeout = 30 * time.Second
+
+// newStressServer starts a hub and a WebSocket endpoint backed by it
+func newStressServer(t *testing.T, cfg ws.Config) (*ws.Hub, *httptest.Server) {
+	hub := ws.NewHub(cfg)
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+
+	svc := service.NewChatService(testRepo, hub, 3)
+	t.Cleanup(svc.Stop)
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+
+	router := http.NewServeMux()
+	router.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(handler.HandleWebsocket)))
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return hub, server
+}
+
+func dialStress(t *testing.T, server *httptest.Server, userID string) *websocket.Conn {
+	conn, err := tryDialStress(server, userID)
+	require.NoError(t, err)
+	readHello(t, conn)
+	return conn
+}
+
+// wsHello is the control frame every WebSocket connection starts with
+type wsHello struct {
+	Type            string `json:"type"`
+	SessionID       string `json:"session_id"`
+	PingIntervalSec int    `json:"ping_interval_sec"`
+	PongTimeoutSec  int    `json:"pong_timeout_sec"`
+}
+
+// readHello reads the connection's first frame, which must be the hello
+func readHello(t *testing.T, conn *websocket.Conn) wsHello {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	messageType, frame, err := conn.ReadMessage()
+	require.NoError(t, err, "Expected a hello frame")
+	conn.SetReadDeadline(time.Time{})
+
+	var hello wsHello
+	require.Equal(t, websocket.TextMessage, messageType)
+	require.NoError(t, json.Unmarshal(frame, &hello))
+	require.Equal(t, "hello", hello.Type)
+	return hello
+}
+
+// tryDialStress is safe to call from goroutines other than the test's own
+func tryDialStress(server *httptest.Server, userID string) (*websocket.Conn, error) {
+	token, err := GenerateTestJWT(userID, jwtSecretTest)
+	if err != nil {
+		return nil, err
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}})
+	return conn, err
+}
+
+// runWithTimeout fails the test if fn doesn't return in time, which is how
+// a deadlock shows up
+func runWithTimeout(t *testing.T, timeout time.Duration, fn func()) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out, the hub is probably deadlocked")
+	}
+}
+
+func waitForConnections(t *testing.T, hub *ws.Hub, userIDs []string, expected int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		total := 0
+		for _, count := range hub.GetChannelParticipantCounts(userIDs) {
+			total += count
+		}
+		if total == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d connections, hub reports %d", expected, total)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStressRegisterUnregisterChurn(t *testing.T) {
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+
+	const (
+		numUsersChurn = 10
+		numChurners   = 50
+		iterations    = 200
+	)
+
+	users := make([]string, numUsersChurn)
+	for i := range users {
+		users[i] = fmt.Sprintf("churn-%d", i)
+	}
+
+	stop := make(chan struct{})
+	var broadcasters sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		broadcasters.Add(1)
+		go func() {
+			defer broadcasters.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					hub.Broadcast(&ws.BroadcastMessage{Participants: users, Message: &models.Message{}, SenderID: users[0]})
+				}
+			}
+		}()
+	}
+
+	runWithTimeout(t, stressTimeout, func() {
+		var churners sync.WaitGroup
+		for g := 0; g < numChurners; g++ {
+			churners.Add(1)
+			go func(g int) {
+				defer churners.Done()
+				for i := 0; i < iterations; i++ {
+					// Clients without a connection only exercise the registry
+					// and their outbox
+					client := ws.NewClient(nil, hub, users[(g+i)%numUsersChurn])
+					hub.Register(client)
+					hub.Register(client)
+
+					// Concurrent double unregister must neither panic nor
+					// corrupt the connection counts
+					var both sync.WaitGroup
+					both.Add(2)
+					go func() { defer both.Done(); hub.Unregister(client) }()
+					go func() { defer both.Done(); hub.Unregister(client) }()
+					both.Wait()
+				}
+			}(g)
+		}
+		churners.Wait()
+	})
+
+	close(stop)
+	broadcasters.Wait()
+
+	waitForConnections(t, hub, users, 0)
+}
+
+func TestStressConnectionChurnWithBroadcasts(t *testing.T) {
+	hub, server := newStressServer(t, ws.DefaultConfig())
+
+	const (
+		numDialers = 20
+		dials      = 20
+	)
+
+	users := make([]string, numDialers)
+	for i := range users {
+		users[i] = fmt.Sprintf("ws-churn-%d", i)
+	}
+
+	stop := make(chan struct{})
+	var broadcaster sync.WaitGroup
+	broadcaster.Add(1)
+	go func() {
+		defer broadcaster.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				hub.Broadcast(&ws.BroadcastMessage{Participants: users, Message: &models.Message{Content: "churn"}, SenderID: "nobody"})
+				time.Sleep(100 * time.Microsecond)
+			}
+		}
+	}()
+
+	runWithTimeout(t, stressTimeout, func() {
+		var dialers sync.WaitGroup
+		for d := 0; d < numDialers; d++ {
+			dialers.Add(1)
+			go func(userID string) {
+				defer dialers.Done()
+				for i := 0; i < dials; i++ {
+					conn, err := tryDialStress(server, userID)
+					if err != nil {
+						t.Errorf("dial failed for %s: %v", userID, err)
+						return
+					}
+					conn.SetReadDeadline(time.Now().Add(time.Duration(i%3) * time.Millisecond))
+					conn.ReadMessage()
+					conn.Close()
+				}
+			}(users[d])
+		}
+		dialers.Wait()
+	})
+
+	close(stop)
+	broadcaster.Wait()
+
+	waitForConnections(t, hub, users, 0)
+
+	// The hub must still deliver after the churn
+	conn := dialStress(t, server, users[0])
+	defer conn.Close()
+	waitForConnections(t, hub, users[:1], 1)
+
+	hub.Broadcast(&ws.BroadcastMessage{Participants: users[:1], Message: &models.Message{Content: "after churn"}, SenderID: "nobody"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(frame), "after churn")
+}
+
+func TestStressSlowConsumerDoesNotStallOthers(t *testing.T) {
+	cfg := ws.DefaultConfig()
+	cfg.SendQueueSize = 4
+	cfg.OverflowPolicy = ws.Disconnect
+	cfg.OverflowGrace = 0
+	hub, server := newStressServer(t, cfg)
+
+	// A client that never drains its outbox
+	slow := ws.NewClient(nil, hub, "slow-consumer")
+	hub.Register(slow)
+
+	fast := dialStress(t, server, "fast-consumer")
+	defer fast.Close()
+	waitForConnections(t, hub, []string{"slow-consumer", "fast-consumer"}, 2)
+
+	// Lock-step: every message must reach the fast consumer even though the
+	// slow one overflows after a few frames and gets dropped
+	const total = 200
+	received := 0
+	runWithTimeout(t, stressTimeout, func() {
+		for i := 0; i < total; i++ {
+			content := fmt.Sprint(i)
+			hub.Broadcast(&ws.BroadcastMessage{
+				Participants: []string{"slow-consumer", "fast-consumer", "sender"},
+				Message:      &models.Message{Content: content},
+				SenderID:     "sender",
+			})
+
+			fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, frame, err := fast.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages, err := ws.JSONCodec.Decode(frame)
+			if err == nil && len(messages) == 1 && messages[0].Content == content {
+				received++
+			}
+		}
+	})
+
+	assert.Equal(t, total, received, "Fast consumer should receive every message")
+	assert.Equal(t, 0, hub.GetUserConnectionCount("slow-consumer"), "Slow consumer should be disconnected")
+}
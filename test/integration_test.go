@@ -1,43 +1,60 @@
 package test
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"chat-microservice/internal/httpapi"
+	"chat-microservice/internal/metrics"
 	"chat-microservice/internal/middleware"
 	"chat-microservice/internal/repository"
+	"chat-microservice/internal/reqctx"
+	"chat-microservice/internal/retry"
 	"chat-microservice/internal/service"
+	"chat-microservice/internal/tracing"
 	"chat-microservice/internal/ws"
 	"chat-microservice/pkg/models"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/time/rate"
 )
 
 const (
-	mongoURITest    = "mongodb://localhost:27017"
-	dbNameTest      = "chat_test"
-	collectionTest  = "messages_test"
-	jwtSecretTest   = "test-secret"
-	numUsers        = 10
-	messagesPerUser = 5
+	mongoURITest      = "mongodb://localhost:27017"
+	dbNameTest        = "chat_test"
+	collectionTest    = "messages_test"
+	jwtSecretTest     = "test-secret"
+	allowedOriginTest = "https://*.example.com"
+	numUsers          = 10
+	messagesPerUser   = 5
 )
 
 var (
 	testServer *httptest.Server
+	testRepo   repository.Repository
 	chatSvc    *service.ChatService
 )
 
@@ -46,6 +63,7 @@ type SimulatedUser struct {
 	ID             string
 	Token          string
 	Conn           *websocket.Conn
+	SessionID      string // from the handshake, sent with every message
 	Received       chan *models.Message
 	sentMessages   map[string]bool // Key: message content
 	mu             sync.RWMutex
@@ -75,6 +93,9 @@ func (u *SimulatedUser) Connect(serverURL string) {
 	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
 	require.NoError(u.t, err, "Failed to connect for user %s", u.ID)
 	u.Conn = conn
+	// Browsers can't read handshake headers, so take the session id from
+	// the hello frame like they do
+	u.SessionID = readHello(u.t, conn).SessionID
 
 	// Start listening for messages
 	go u.listen()
@@ -92,17 +113,17 @@ func (u *SimulatedUser) listen() {
 			return
 		}
 
-		var msg models.Message
-		err = json.Unmarshal(message, &msg)
+		// A frame may hold several newline-delimited messages when the
+		// server batches writes
+		messages, err := ws.JSONCodec.Decode(message)
 		require.NoError(u.t, err)
 
-		// Don't count our own messages
-		if msg.Sender == u.ID {
-			continue
+		// Messages sent over REST carry our session id, so the server
+		// doesn't echo them back to this connection
+		for _, msg := range messages {
+			u.Received <- msg
+			u.wg.Done()
 		}
-
-		u.Received <- &msg
-		u.wg.Done()
 	}
 }
 
@@ -119,6 +140,9 @@ func (u *SimulatedUser) SendMessage(participants []string, content string) {
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+u.Token)
+	if u.SessionID != "" {
+		req.Header.Set("X-Session-ID", u.SessionID)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	require.NoError(u.t, err)
@@ -142,19 +166,30 @@ func TestMain(m *testing.M) {
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	repo.Collection().Drop(ctx)
+	repo.Drop(ctx)
+	testRepo = repo
 
 	// Setup server
-	hub := ws.NewHub()
+	hub := ws.NewHub(ws.DefaultConfig())
 	go hub.Run()
 	chatSvc = service.NewChatService(repo, hub, 3)
-	handler := httpapi.NewHandler(chatSvc)
+	cors, err := middleware.NewCORS([]string{allowedOriginTest})
+	if err != nil {
+		log.Fatalf("Invalid allowed origin: %v", err)
+	}
+	handler := httpapi.NewHandler(chatSvc, cors.CheckOrigin)
 	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
 
 	router := http.NewServeMux()
 	router.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(handler.HandleWebsocket)))
-	router.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage)))
+	router.Handle("/api/messages", cors.Middleware(authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage))))
 	router.Handle("/api/messages/get", authMiddleware.Verify(http.HandlerFunc(handler.HandleGetMessages)))
+	router.Handle("/api/messages/range", authMiddleware.Verify(http.HandlerFunc(handler.HandleGetMessageRange)))
+	router.Handle("/api/events", authMiddleware.Verify(http.HandlerFunc(handler.HandleEvents)))
+	router.Handle("/api/poll", authMiddleware.Verify(http.HandlerFunc(handler.HandlePoll)))
+	router.Handle("GET /api/sessions", authMiddleware.Verify(http.HandlerFunc(handler.HandleListSessions)))
+	router.Handle("DELETE /api/sessions/{id}", authMiddleware.Verify(http.HandlerFunc(handler.HandleDeleteSession)))
+	router.Handle("/api/connections", authMiddleware.Verify(middleware.RequireScopes(middleware.ScopeAdmin)(http.HandlerFunc(handler.HandleGetUserConnections))))
 
 	testServer = httptest.NewServer(router)
 	defer testServer.Close()
@@ -483,7 +518,7 @@ func TestRateLimiting(t *testing.T) {
 		t.Skip("Skipping test: MongoDB not available")
 	}
 
-	hub := ws.NewHub()
+	hub := ws.NewHub(ws.DefaultConfig())
 	go hub.Run()
 	svc := service.NewChatService(repo, hub, 3)
 	defer svc.Stop()
@@ -491,7 +526,7 @@ func TestRateLimiting(t *testing.T) {
 	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
 	rateLimiter := middleware.NewRateLimiter(rate.Limit(rateLimitRPS), rateLimitBurst)
 
-	handler := httpapi.NewHandler(svc)
+	handler := httpapi.NewHandler(svc, nil)
 
 	router := http.NewServeMux()
 	router.Handle("/api/messages", authMiddleware.Verify(rateLimiter.Middleware(http.HandlerFunc(handler.HandleSendMessage))))
@@ -544,6 +579,179 @@ func TestRateLimiting(t *testing.T) {
 	log.Println("Rate limiting test completed successfully!")
 }
 
+func TestRateLimitPolicies(t *testing.T) {
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(chatSvc, nil)
+
+	rateLimiter := middleware.NewRateLimiter(rate.Limit(100), 100)
+	defer rateLimiter.Stop()
+	rateLimiter.SetRoutePolicy("/api/messages", middleware.Policy{Rate: rate.Limit(0.5), Burst: 2})
+
+	ipLimiter := middleware.NewRateLimiter(rate.Limit(0.5), 1)
+	defer ipLimiter.Stop()
+
+	api := http.NewServeMux()
+	api.HandleFunc("/api/messages", handler.HandleSendMessage)
+	api.HandleFunc("/api/messages/get", handler.HandleGetMessages)
+
+	router := http.NewServeMux()
+	router.Handle("/api/", authMiddleware.Verify(rateLimiter.Middleware(api)))
+	router.Handle("/public", ipLimiter.IPMiddleware(http.HandlerFunc(handler.Health)))
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 998, &wg)
+
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	// Sending has a stricter policy than the default
+	payload := `{"participants": ["user-998"], "content": "policy test"}`
+	resp := do("POST", "/api/messages", payload)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-RateLimit-Limit"))
+	assert.Equal(t, "1", resp.Header.Get("X-RateLimit-Remaining"))
+
+	do("POST", "/api/messages", payload)
+	resp = do("POST", "/api/messages", payload)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "Expected send policy to be exhausted")
+	assert.Equal(t, "0", resp.Header.Get("X-RateLimit-Remaining"))
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"), "Expected Retry-After on 429")
+
+	// History reads are counted against a separate bucket
+	resp = do("GET", "/api/messages/get?participants=user-998", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected history read to be unaffected by send limit")
+	assert.Equal(t, "100", resp.Header.Get("X-RateLimit-Limit"))
+
+	// Unauthenticated paths are limited per client IP
+	resp = do("GET", "/public", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = do("GET", "/public", "")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "Expected IP limit to be exceeded")
+
+	log.Println("Rate limit policy test completed successfully!")
+}
+
+func TestDistributedRateLimiting(t *testing.T) {
+	store := miniredis.RunT(t)
+	policy := middleware.Policy{Rate: rate.Limit(0.5), Burst: 3}
+
+	// Two replicas, each with its own connection to the shared store
+	var replicas []*httptest.Server
+	for i := 0; i < 2; i++ {
+		client := redis.NewClient(&redis.Options{Addr: store.Addr()})
+		defer client.Close()
+
+		limiter := middleware.NewRateLimiterWithBackend(middleware.NewRedisBackend(client, ""), policy)
+		authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+		handler := httpapi.NewHandler(chatSvc, nil)
+
+		router := http.NewServeMux()
+		router.Handle("/api/messages/get", authMiddleware.Verify(limiter.Middleware(http.HandlerFunc(handler.HandleGetMessages))))
+
+		server := httptest.NewServer(router)
+		defer server.Close()
+		replicas = append(replicas, server)
+	}
+
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 996, &wg)
+
+	statuses := make([]int, 0, policy.Burst+1)
+	var lastResp *http.Response
+	for i := 0; i <= policy.Burst; i++ {
+		server := replicas[i%len(replicas)]
+		req, _ := http.NewRequest("GET", server.URL+"/api/messages/get?participants=user-996", nil)
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+		lastResp = resp
+	}
+
+	assert.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests}, statuses,
+		"Expected the burst to be shared by both replicas")
+	assert.Equal(t, "2", lastResp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", lastResp.Header.Get("X-RateLimit-Remaining"))
+
+	log.Println("Distributed rate limiting test completed successfully!")
+}
+
+func TestWebSocketFrameFlood(t *testing.T) {
+	cfg := ws.DefaultConfig()
+	cfg.MaxFrameSize = 64
+	cfg.ConnFrameRate = rate.Limit(0.1)
+	cfg.ConnFrameBurst = 2
+	cfg.WarnAfter = 2
+	cfg.CloseAfter = 4
+
+	hub := ws.NewHub(cfg)
+	go hub.Run()
+	svc := service.NewChatService(testRepo, hub, 3)
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+
+	router := http.NewServeMux()
+	router.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(handler.HandleWebsocket)))
+
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 997, &wg)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	header := http.Header{"Authorization": {"Bearer " + user.Token}}
+
+	// Flooding: the burst is accepted, then frames are dropped, the client is
+	// warned and finally disconnected with a policy violation
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	require.NoError(t, err)
+	defer conn.Close()
+	readHello(t, conn)
+
+	for i := 0; i < cfg.ConnFrameBurst+cfg.CloseAfter; i++ {
+		require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte("flood")))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, frame, err := conn.ReadMessage()
+	require.NoError(t, err, "Expected a warning frame before disconnect")
+
+	var warning map[string]string
+	require.NoError(t, json.Unmarshal(frame, &warning))
+	assert.Equal(t, "warning", warning["type"])
+	assert.Equal(t, "rate_limited", warning["code"])
+
+	_, _, err = conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "Expected policy violation close, got %v", err)
+
+	// Oversized frames close the connection straight away
+	conn2, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	require.NoError(t, err)
+	defer conn2.Close()
+	readHello(t, conn2)
+
+	require.NoError(t, conn2.WriteMessage(websocket.TextMessage, make([]byte, cfg.MaxFrameSize+1)))
+	conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err = conn2.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "Expected message too big close, got %v", err)
+
+	log.Println("WebSocket frame flood test completed successfully!")
+}
+
 func TestInvalidToken(t *testing.T) {
 	var wg sync.WaitGroup
 	user := NewSimulatedUser(t, 888, &wg)
@@ -567,6 +775,2076 @@ func TestInvalidToken(t *testing.T) {
 	log.Println("Invalid token test completed successfully!")
 }
 
+func TestConnectionsRequireAdminScope(t *testing.T) {
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 777, &wg)
+
+	adminToken, err := GenerateTestJWTWithScopes("admin-777", jwtSecretTest, middleware.ScopeAdmin)
+	require.NoError(t, err)
+
+	url := testServer.URL + "/api/connections"
+	payload := `{"users": ["user-777"]}`
+
+	cases := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"regular user", user.Token, http.StatusForbidden},
+		{"admin", adminToken, http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		req, _ := http.NewRequest("POST", url, strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+
+		assert.Equal(t, tc.status, resp.StatusCode, "Unexpected status for %s", tc.name)
+	}
+
+	log.Println("Admin scope test completed successfully!")
+}
+
+func TestOriginAllowList(t *testing.T) {
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 666, &wg)
+
+	// Preflight requests are answered without authentication
+	preflight := func(origin string) *http.Response {
+		req, _ := http.NewRequest("OPTIONS", testServer.URL+"/api/messages", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := preflight("https://app.example.com")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Expected preflight from allowed origin to succeed")
+	assert.Equal(t, "https://app.example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+
+	resp = preflight("https://app.example.com:443")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode, "Expected the default port to match a pattern without one")
+
+	resp = preflight("https://app.example.com:8443")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Expected another port not to match a pattern without one")
+
+	resp = preflight("https://example.com.evil.io")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Expected preflight from unknown origin to be rejected")
+	assert.Empty(t, resp.Header.Get("Access-Control-Allow-Origin"))
+
+	// Cross-site WebSocket handshakes must match the allow-list too
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+	dial := func(origin string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{"Authorization": {"Bearer " + user.Token}, "Origin": {origin}}
+		return websocket.DefaultDialer.Dial(wsURL, header)
+	}
+
+	conn, _, err := dial("https://app.example.com")
+	require.NoError(t, err, "Expected handshake from allowed origin to succeed")
+	conn.Close()
+
+	_, resp, err = dial("https://evil.io")
+	require.Error(t, err, "Expected handshake from unknown origin to fail")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// Patterns are parsed like Origin headers, so IPv6 addresses match
+	// without their brackets and entries that aren't origins fail at startup
+	cors, err := middleware.NewCORS([]string{"http://[::1]:3000", "HTTPS://Chat.Example.com/"})
+	require.NoError(t, err)
+	assert.True(t, cors.AllowOrigin("http://[::1]:3000"))
+	assert.False(t, cors.AllowOrigin("http://[::1]:4000"))
+	assert.True(t, cors.AllowOrigin("https://chat.example.com"))
+
+	for _, entry := range []string{
+		"https://example.com/app",
+		"https://example.com:port",
+		"https://*.",
+		"https://app.*.example.com",
+		"https://user@example.com",
+	} {
+		_, err := middleware.NewCORS([]string{entry})
+		assert.Error(t, err, "Expected %q to be rejected", entry)
+	}
+
+	log.Println("Origin allow-list test completed successfully!")
+}
+
+func TestWireFormatNegotiation(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 555, &wg)
+
+	cases := []struct {
+		subprotocols []string
+		codec        ws.Codec
+		messageType  int
+	}{
+		{nil, ws.JSONCodec, websocket.TextMessage},
+		{[]string{"chat.unknown"}, ws.JSONCodec, websocket.TextMessage},
+		{[]string{"chat.msgpack"}, ws.MsgpackCodec, websocket.BinaryMessage},
+		{[]string{"chat.json", "chat.protobuf"}, ws.ProtobufCodec, websocket.BinaryMessage},
+	}
+
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+	participants := []string{sender.ID}
+	conns := make([]*websocket.Conn, len(cases))
+	for i, tc := range cases {
+		receiver := NewSimulatedUser(t, 550+i, &wg)
+		participants = append(participants, receiver.ID)
+
+		dialer := websocket.Dialer{Subprotocols: tc.subprotocols}
+		conn, _, err := dialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + receiver.Token}})
+		require.NoError(t, err)
+		defer conn.Close()
+		if tc.codec != ws.JSONCodec {
+			assert.Equal(t, tc.codec.Subprotocol(), conn.Subprotocol())
+		}
+		// The hello is JSON whatever the wire format
+		readHello(t, conn)
+		conns[i] = conn
+	}
+	waitForConnections(t, chatSvc.Hub(), participants[1:], len(cases))
+
+	sender.SendMessage(participants, "wire format test")
+
+	for i, tc := range cases {
+		conns[i].SetReadDeadline(time.Now().Add(5 * time.Second))
+		messageType, frame, err := conns[i].ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, tc.messageType, messageType, "Unexpected frame type for %v", tc.subprotocols)
+
+		messages, err := tc.codec.Decode(frame)
+		require.NoError(t, err, "Failed to decode frame for %v", tc.subprotocols)
+		require.Len(t, messages, 1)
+		assert.Equal(t, sender.ID, messages[0].Sender)
+		assert.Equal(t, "wire format test", messages[0].Content)
+		assert.ElementsMatch(t, participants, messages[0].Participants)
+		assert.False(t, messages[0].CreatedAt.IsZero())
+		assert.Len(t, messages[0].ID, 26)
+		assert.Equal(t, uint64(1), messages[0].Seq)
+	}
+
+	log.Println("Wire format negotiation test completed successfully!")
+}
+
+func TestCompressionAndWriteBatching(t *testing.T) {
+	const total = 500
+	cfg := ws.DefaultConfig()
+	cfg.CompressionThreshold = 256
+	cfg.SendQueueSize = total
+	hub, server := newStressServer(t, cfg)
+
+	token, err := GenerateTestJWT("user-deflate", jwtSecretTest)
+	require.NoError(t, err)
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// Batching only applies to clients that negotiated a subprotocol
+	dialer := websocket.Dialer{EnableCompression: true, Subprotocols: []string{"chat.json"}}
+	conn, resp, err := dialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + token}})
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Contains(t, resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+	readHello(t, conn)
+	waitForConnections(t, hub, []string{"user-deflate"}, 1)
+
+	// Messages queued faster than they are written arrive batched into
+	// fewer frames, newline delimited, without losing or reordering any
+	large := strings.Repeat("compressible ", 100)
+	broadcast := func(userID string, n int) {
+		for i := 0; i < n; i++ {
+			hub.Broadcast(&ws.BroadcastMessage{
+				Participants: []string{userID},
+				Message:      &models.Message{Sender: "sender", Content: fmt.Sprintf("%d %s", i, large)},
+				SenderID:     "sender",
+			})
+		}
+	}
+	broadcast("user-deflate", total)
+
+	received, frames := 0, 0
+	for received < total {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, frame, err := conn.ReadMessage()
+		require.NoError(t, err, "Received %d of %d messages", received, total)
+		frames++
+
+		messages, err := ws.JSONCodec.Decode(frame)
+		require.NoError(t, err)
+		for _, msg := range messages {
+			assert.Equal(t, fmt.Sprintf("%d %s", received, large), msg.Content)
+			received++
+		}
+	}
+	assert.LessOrEqual(t, frames, total)
+	log.Printf("Received %d messages in %d frames", received, frames)
+
+	// A plain JSON client gets exactly one message per frame
+	plainToken, err := GenerateTestJWT("user-plain", jwtSecretTest)
+	require.NoError(t, err)
+	plain, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer " + plainToken}})
+	require.NoError(t, err)
+	defer plain.Close()
+	readHello(t, plain)
+	waitForConnections(t, hub, []string{"user-plain"}, 1)
+
+	const plainTotal = 50
+	broadcast("user-plain", plainTotal)
+	for i := 0; i < plainTotal; i++ {
+		plain.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, frame, err := plain.ReadMessage()
+		require.NoError(t, err)
+		var msg models.Message
+		require.NoError(t, json.Unmarshal(frame, &msg), "Expected a single JSON message per frame")
+		assert.Equal(t, fmt.Sprintf("%d %s", i, large), msg.Content)
+	}
+
+	// Compression is only offered when enabled
+	cfg.Compression = false
+	_, plainServer := newStressServer(t, cfg)
+	plainURL := "ws" + strings.TrimPrefix(plainServer.URL, "http") + "/ws"
+	conn2, resp, err := dialer.Dial(plainURL, http.Header{"Authorization": {"Bearer " + token}})
+	require.NoError(t, err)
+	defer conn2.Close()
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	log.Println("Compression and write batching test completed successfully!")
+}
+
+func TestServerSentEvents(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 444, &wg)
+	receiver := NewSimulatedUser(t, 445, &wg)
+	participants := []string{sender.ID, receiver.ID}
+
+	// The stream starts with a hello event carrying the session id, since
+	// EventSource can't read response headers
+	openStream := func(lastEventID, sessionID string) (*http.Response, *bufio.Reader, string) {
+		req, _ := http.NewRequest("GET", testServer.URL+"/api/events?session_id="+sessionID, nil)
+		req.Header.Set("Authorization", "Bearer "+receiver.Token)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		stream := bufio.NewReader(resp.Body)
+		event, _, data := readSSEEvent(t, stream)
+		require.Equal(t, "hello", event)
+		var hello struct {
+			SessionID string `json:"session_id"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(data), &hello))
+		require.NotEmpty(t, hello.SessionID)
+		return resp, stream, hello.SessionID
+	}
+
+	resp, stream, sessionID := openStream("", "")
+	waitForConnections(t, chatSvc.Hub(), []string{receiver.ID}, 1)
+	subs := chatSvc.Hub().Subscribers(receiver.ID)
+	require.Len(t, subs, 1)
+	assert.Equal(t, sessionID, subs[0].Session().ID)
+
+	sender.SendMessage(participants, "sse 1")
+	id, msg := readSSEMessage(t, stream)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, "sse 1", msg.Content)
+	assert.Equal(t, sender.ID, msg.Sender)
+
+	// Messages sent while the client is disconnected are replayed when it
+	// comes back with Last-Event-ID
+	resp.Body.Close()
+	waitForConnections(t, chatSvc.Hub(), []string{receiver.ID}, 0)
+	sender.SendMessage(participants, "sse 2")
+	sender.SendMessage(participants, "sse 3")
+	time.Sleep(100 * time.Millisecond)
+
+	// Reconnecting with the session id keeps the session
+	resp, stream, resumed := openStream(id, sessionID)
+	defer resp.Body.Close()
+	assert.Equal(t, sessionID, resumed)
+	_, msg = readSSEMessage(t, stream)
+	assert.Equal(t, "sse 2", msg.Content)
+	_, msg = readSSEMessage(t, stream)
+	assert.Equal(t, "sse 3", msg.Content)
+
+	req, _ := http.NewRequest("GET", testServer.URL+"/api/events?session_id=not-a-session", nil)
+	req.Header.Set("Authorization", "Bearer "+receiver.Token)
+	badResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	badResp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, badResp.StatusCode)
+
+	log.Println("Server-Sent Events test completed successfully!")
+}
+
+func TestLongPolling(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 446, &wg)
+	receiver := NewSimulatedUser(t, 447, &wg)
+	participants := []string{sender.ID, receiver.ID}
+
+	type pollResult struct {
+		Events []struct {
+			ID      string         `json:"id"`
+			Message models.Message `json:"message"`
+		} `json:"events"`
+		Cursor    string `json:"cursor"`
+		SessionID string `json:"session_id"`
+	}
+	sessionID := ""
+	poll := func(cursor string, timeout int) pollResult {
+		url := fmt.Sprintf("%s/api/poll?cursor=%s&timeout=%d&session_id=%s", testServer.URL, cursor, timeout, sessionID)
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+receiver.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result pollResult
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return result
+	}
+
+	// The first poll only establishes a cursor and a session; passing the
+	// session id back keeps later polls the same session
+	result := poll("", 0)
+	assert.Empty(t, result.Events)
+	require.NotEmpty(t, result.Cursor)
+	require.NotEmpty(t, result.SessionID)
+	sessionID = result.SessionID
+
+	// Messages sent between polls are picked up by the next one
+	sender.SendMessage(participants, "poll 1")
+	time.Sleep(100 * time.Millisecond)
+	result = poll(result.Cursor, 5)
+	require.Len(t, result.Events, 1)
+	assert.Equal(t, "poll 1", result.Events[0].Message.Content)
+	assert.Equal(t, result.Events[0].ID, result.Cursor)
+
+	// A waiting poll returns as soon as a message arrives
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		sender.SendMessage(participants, "poll 2")
+	}()
+	start := time.Now()
+	result = poll(result.Cursor, 10)
+	require.Len(t, result.Events, 1)
+	assert.Equal(t, "poll 2", result.Events[0].Message.Content)
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	// Nothing new: the poll times out empty and keeps the cursor
+	cursor := result.Cursor
+	result = poll(cursor, 1)
+	assert.Empty(t, result.Events)
+	assert.Equal(t, cursor, result.Cursor)
+	assert.Equal(t, sessionID, result.SessionID)
+
+	log.Println("Long polling test completed successfully!")
+}
+
+func TestKeepaliveNegotiation(t *testing.T) {
+	cfg := ws.DefaultConfig()
+	cfg.MinPingPeriod = time.Second
+	cfg.MaxPingPeriod = time.Minute
+	hub, server := newStressServer(t, cfg)
+
+	token, err := GenerateTestJWT("user-keepalive", jwtSecretTest)
+	require.NoError(t, err)
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// Requests outside the allowed range are clamped, and the pong timeout
+	// keeps the default ratio to the ping interval. Browsers can't read the
+	// headers, so the hello frame carries the same values.
+	conn, resp, err := websocket.DefaultDialer.Dial(wsURL+"?ping_interval=3600", header)
+	require.NoError(t, err)
+	hello := readHello(t, conn)
+	conn.Close()
+	assert.Equal(t, "60", resp.Header.Get("X-Ping-Interval"))
+	assert.Equal(t, "66", resp.Header.Get("X-Pong-Timeout"))
+	assert.Equal(t, 60, hello.PingIntervalSec)
+	assert.Equal(t, 66, hello.PongTimeoutSec)
+
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL+"?ping_interval=soon", header)
+	require.Error(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// A short interval is honoured and pongs are timed
+	conn, resp, err = websocket.DefaultDialer.Dial(wsURL+"?ping_interval=1&pong_timeout=5", header)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, "1", resp.Header.Get("X-Ping-Interval"))
+	assert.Equal(t, "5", resp.Header.Get("X-Pong-Timeout"))
+	hello = readHello(t, conn)
+	assert.Equal(t, 1, hello.PingIntervalSec)
+	assert.Equal(t, 5, hello.PongTimeoutSec)
+
+	// The default ping handler answers pings while the client reads
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hub.RTTStats().Pongs < 2 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	stats := hub.RTTStats()
+	assert.GreaterOrEqual(t, stats.Pongs, uint64(2), "Expected pongs to be timed")
+	assert.Equal(t, stats.Pongs, stats.Buckets[len(stats.Buckets)-1].Count)
+
+	// Pongs the client makes up aren't timed: neither stale nor future
+	// timestamps skew the round trips
+	for _, payload := range []string{
+		"1",
+		fmt.Sprint(time.Now().Add(time.Hour).UnixNano()),
+		"not a timestamp",
+	} {
+		require.NoError(t, conn.WriteControl(websocket.PongMessage, []byte(payload), time.Now().Add(time.Second)))
+	}
+	pongs := hub.RTTStats().Pongs
+	require.Eventually(t, func() bool {
+		return hub.RTTStats().Pongs > pongs
+	}, 5*time.Second, 100*time.Millisecond, "Expected pongs of real pings to be timed")
+	stats = hub.RTTStats()
+	assert.Equal(t, stats.Pongs, stats.Buckets[len(stats.Buckets)-2].Count, "Forged pong timed as a long round trip")
+	assert.GreaterOrEqual(t, stats.MeanMs, 0.0, "Forged pong timed as a negative round trip")
+
+	log.Println("Keepalive negotiation test completed successfully!")
+}
+
+func TestSessionManagement(t *testing.T) {
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 333, &wg)
+	other := NewSimulatedUser(t, 334, &wg)
+	wsURL := "ws" + strings.TrimPrefix(testServer.URL, "http") + "/ws"
+
+	connect := func(deviceID, userAgent string) (*websocket.Conn, string) {
+		header := http.Header{"Authorization": {"Bearer " + user.Token}, "User-Agent": {userAgent}}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL+"?device_id="+deviceID, header)
+		require.NoError(t, err)
+		hello := readHello(t, conn)
+		require.NotEmpty(t, hello.SessionID)
+		assert.Equal(t, resp.Header.Get("X-Session-ID"), hello.SessionID)
+		return conn, hello.SessionID
+	}
+	phone, phoneSession := connect("phone", "ChatApp/2.1 (iOS)")
+	defer phone.Close()
+	desktop, desktopSession := connect("desktop", "Mozilla/5.0")
+	defer desktop.Close()
+	waitForConnections(t, chatSvc.Hub(), []string{user.ID}, 2)
+
+	request := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, testServer.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return resp
+	}
+	listSessions := func() map[string]ws.Session {
+		resp := request("GET", "/api/sessions", user.Token)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var body struct {
+			Sessions []ws.Session `json:"sessions"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		sessions := make(map[string]ws.Session)
+		for _, s := range body.Sessions {
+			sessions[s.ID] = s
+		}
+		return sessions
+	}
+
+	sessions := listSessions()
+	require.Len(t, sessions, 2)
+	assert.Equal(t, "phone", sessions[phoneSession].DeviceID)
+	assert.Equal(t, "ChatApp/2.1 (iOS)", sessions[phoneSession].UserAgent)
+	assert.Equal(t, ws.TransportWebSocket, sessions[phoneSession].Transport)
+	assert.False(t, sessions[phoneSession].ConnectedAt.IsZero())
+	assert.Equal(t, "desktop", sessions[desktopSession].DeviceID)
+
+	// Other users can't see or end someone else's sessions
+	resp := request("DELETE", "/api/sessions/"+phoneSession, other.Token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// Ending the phone session closes its socket with a code telling it not
+	// to reconnect, and leaves the desktop connected
+	resp = request("DELETE", "/api/sessions/"+phoneSession, user.Token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	phone.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := phone.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, ws.CloseSessionTerminated), "Expected session terminated close, got %v", err)
+
+	waitForConnections(t, chatSvc.Hub(), []string{user.ID}, 1)
+	sessions = listSessions()
+	require.Len(t, sessions, 1)
+	assert.Contains(t, sessions, desktopSession)
+
+	resp = request("DELETE", "/api/sessions/"+phoneSession, user.Token)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	log.Println("Session management test completed successfully!")
+}
+
+func TestEchoToSenderDevices(t *testing.T) {
+	var wg sync.WaitGroup
+	recipient := NewSimulatedUser(t, 223, &wg)
+	phone := NewSimulatedUser(t, 222, &wg)
+	desktop := NewSimulatedUser(t, 222, &wg)
+	participants := []string{phone.ID, recipient.ID}
+
+	recipient.Connect(testServer.URL)
+	defer recipient.Close()
+	phone.Connect(testServer.URL)
+	defer phone.Close()
+	desktop.Connect(testServer.URL)
+	defer desktop.Close()
+	waitForConnections(t, chatSvc.Hub(), participants, 3)
+
+	// Sent from the phone: the desktop and the recipient get it, the phone
+	// doesn't get its own message back
+	wg.Add(2)
+	phone.SendMessage(participants, "sent from phone")
+	waitTimeout(&wg, 5*time.Second, t)
+
+	for _, u := range []*SimulatedUser{recipient, desktop} {
+		select {
+		case msg := <-u.Received:
+			assert.Equal(t, "sent from phone", msg.Content)
+			assert.Equal(t, phone.ID, msg.Sender)
+		default:
+			t.Errorf("Expected %s (%s) to receive the message", u.ID, u.SessionID)
+		}
+	}
+
+	// Without an origin session every device of the sender gets the echo
+	wg.Add(3)
+	url := testServer.URL + "/api/messages"
+	payload := fmt.Sprintf(`{"participants": ["%s", "%s"], "content": "sent without session"}`, phone.ID, recipient.ID)
+	req, _ := http.NewRequest("POST", url, strings.NewReader(payload))
+	req.Header.Set("Authorization", "Bearer "+phone.Token)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	waitTimeout(&wg, 5*time.Second, t)
+
+	for _, u := range []*SimulatedUser{recipient, desktop, phone} {
+		select {
+		case msg := <-u.Received:
+			assert.Equal(t, "sent without session", msg.Content)
+		default:
+			t.Errorf("Expected %s (%s) to receive the message", u.ID, u.SessionID)
+		}
+	}
+
+	log.Println("Echo to sender devices test completed successfully!")
+}
+
+func TestIdempotentSends(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 224, &wg)
+	recipient := NewSimulatedUser(t, 225, &wg)
+	participants := []string{sender.ID, recipient.ID}
+
+	recipient.Connect(testServer.URL)
+	defer recipient.Close()
+	waitForConnections(t, chatSvc.Hub(), []string{recipient.ID}, 1)
+
+	sendTo := func(serverURL string, u *SimulatedUser, clientMsgID string) (int, map[string]any) {
+		payload := fmt.Sprintf(`{"participants": ["%s", "%s"], "content": "idempotent", "client_msg_id": "%s"}`, sender.ID, recipient.ID, clientMsgID)
+		req, _ := http.NewRequest("POST", serverURL+"/api/messages", strings.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+	send := func(u *SimulatedUser, clientMsgID string) (int, map[string]any) {
+		return sendTo(testServer.URL, u, clientMsgID)
+	}
+
+	// The first send is accepted with a server-assigned ULID
+	wg.Add(1)
+	status, first := send(sender, "retry-1")
+	require.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "message queued", first["status"])
+	assert.Len(t, first["id"], 26)
+	assert.NotZero(t, first["seq"])
+	assert.Equal(t, "retry-1", first["client_msg_id"])
+	waitTimeout(&wg, 5*time.Second, t)
+
+	// Retrying returns the same id without delivering the message again
+	status, retry := send(sender, "retry-1")
+	require.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "duplicate", retry["status"])
+	assert.Equal(t, first["id"], retry["id"])
+
+	msg := <-recipient.Received
+	assert.Equal(t, first["id"], msg.ID)
+	assert.Equal(t, "retry-1", msg.ClientMsgID)
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, recipient.Received, "Retried send was delivered twice")
+
+	// Client ids are scoped to the sender
+	wg.Add(1)
+	status, other := send(recipient, "retry-1")
+	require.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "message queued", other["status"])
+	assert.NotEqual(t, first["id"], other["id"])
+	waitTimeout(&wg, 5*time.Second, t)
+	<-recipient.Received
+
+	// A client id longer than 64 characters is rejected
+	status, _ = send(sender, strings.Repeat("x", 65))
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Only one message per sender is stored
+	url := fmt.Sprintf("%s/api/messages/get?participants=%s", testServer.URL, strings.Join(participants, ","))
+	require.Eventually(t, func() bool {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Authorization", "Bearer "+sender.Token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+
+		var messages []*models.Message
+		json.NewDecoder(resp.Body).Decode(&messages)
+		return len(messages) == 2
+	}, 5*time.Second, 50*time.Millisecond, "Expected one stored message per sender")
+
+	// A retry reaching another instance, whose dedup cache never saw the
+	// first send, gets the stored message and isn't broadcast again
+	replicaHub := ws.NewHub(ws.DefaultConfig())
+	go replicaHub.Run()
+	defer replicaHub.Stop()
+	replica := service.NewChatService(testRepo, replicaHub, 3)
+	defer replica.Stop()
+	replicaHandler := httpapi.NewHandler(replica, nil)
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	replicaRouter := http.NewServeMux()
+	replicaRouter.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(replicaHandler.HandleWebsocket)))
+	replicaRouter.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(replicaHandler.HandleSendMessage)))
+	replicaServer := httptest.NewServer(replicaRouter)
+	defer replicaServer.Close()
+
+	var replicaWG sync.WaitGroup
+	replicaRecipient := NewSimulatedUser(t, 225, &replicaWG)
+	replicaRecipient.Connect(replicaServer.URL)
+	defer replicaRecipient.Close()
+	waitForConnections(t, replicaHub, []string{recipient.ID}, 1)
+
+	status, retry = sendTo(replicaServer.URL, sender, "retry-1")
+	require.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "duplicate", retry["status"])
+	assert.Equal(t, first["id"], retry["id"])
+	assert.Equal(t, first["seq"], retry["seq"])
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, replicaRecipient.Received, "Retried send was broadcast by another instance")
+
+	history, err := testRepo.GetMessagesByParticipants(context.Background(), participants)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+
+	// Two instances that both accept a send before either stored it keep
+	// the first one stored; the other's sequence number goes to a
+	// placeholder pointing at it, so gap fills don't wait for it forever
+	ctx := context.Background()
+	held := &heldRepo{Repository: testRepo, release: make(chan struct{})}
+	slow := service.NewChatService(held, replicaHub, 3)
+	defer slow.Stop()
+	raced := func(svc *service.ChatService) *models.Message {
+		accepted, duplicate, err := svc.BroadcastMessage(ctx, &models.Message{
+			Sender:       sender.ID,
+			ClientMsgID:  "retry-2",
+			Content:      "raced",
+			CreatedAt:    time.Now(),
+			Participants: participants,
+		}, "")
+		require.NoError(t, err)
+		require.False(t, duplicate)
+		return accepted
+	}
+	replicaWG.Add(2)
+	lost := raced(slow)
+	won := raced(replica)
+	waitTimeout(&replicaWG, 5*time.Second, t)
+	require.Eventually(t, func() bool {
+		stored, err := testRepo.GetMessageByClientMsgID(ctx, sender.ID, "retry-2")
+		return err == nil && stored.ID == won.ID
+	}, 5*time.Second, 10*time.Millisecond)
+	close(held.release)
+
+	var placeholder []*models.Message
+	require.Eventually(t, func() bool {
+		placeholder, err = testRepo.GetMessagesBySeqRange(ctx, participants, lost.Seq, lost.Seq, 10)
+		return err == nil && len(placeholder) == 1
+	}, 5*time.Second, 10*time.Millisecond, "Expected a placeholder for the lost send's seq")
+	assert.Equal(t, lost.ID, placeholder[0].ID)
+	assert.Equal(t, won.ID, placeholder[0].DuplicateOf)
+	assert.Empty(t, placeholder[0].Content)
+
+	history, err = testRepo.GetMessagesByParticipants(ctx, participants)
+	require.NoError(t, err)
+	assert.Len(t, history, 3, "Expected history to leave out the placeholder")
+
+	log.Println("Idempotent sends test completed successfully!")
+}
+
+// heldRepo holds every batch until release is closed or its context is done
+type heldRepo struct {
+	repository.Repository
+	release chan struct{}
+}
+
+func (r *heldRepo) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.Repository.SaveBatch(ctx, msgs)
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 226, &wg)
+	recipient := NewSimulatedUser(t, 227, &wg)
+	participants := []string{sender.ID, recipient.ID}
+
+	recipient.Connect(testServer.URL)
+	defer recipient.Close()
+	waitForConnections(t, chatSvc.Hub(), []string{recipient.ID}, 1)
+
+	const count = 5
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		sender.SendMessage(participants, fmt.Sprintf("seq message %d", i))
+	}
+	waitTimeout(&wg, 5*time.Second, t)
+
+	// Every broadcast carries the next number of the channel
+	for i := 1; i <= count; i++ {
+		msg := <-recipient.Received
+		assert.Equal(t, uint64(i), msg.Seq)
+		assert.Equal(t, fmt.Sprintf("seq message %d", i-1), msg.Content)
+	}
+
+	// Another channel of the same sender has its own sequence
+	wg.Add(1)
+	sender.SendMessage([]string{sender.ID, recipient.ID, "user-228"}, "other channel")
+	waitTimeout(&wg, 5*time.Second, t)
+	msg := <-recipient.Received
+	assert.Equal(t, uint64(1), msg.Seq)
+
+	get := func(path string) (int, []*models.Message) {
+		req, _ := http.NewRequest("GET", testServer.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+recipient.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var messages []*models.Message
+		json.NewDecoder(resp.Body).Decode(&messages)
+		return resp.StatusCode, messages
+	}
+	channel := strings.Join(participants, ",")
+
+	// A gap fill returns the requested range oldest first once stored
+	var filled []*models.Message
+	require.Eventually(t, func() bool {
+		_, filled = get("/api/messages/range?participants=" + channel + "&from_seq=2&to_seq=4")
+		return len(filled) == 3
+	}, 5*time.Second, 50*time.Millisecond, "Expected the gap fill to return 3 messages")
+	for i, m := range filled {
+		assert.Equal(t, uint64(i+2), m.Seq)
+	}
+
+	// History is ordered by sequence number, newest first
+	status, history := get("/api/messages/get?participants=" + channel)
+	require.Equal(t, http.StatusOK, status)
+	require.Len(t, history, count)
+	for i, m := range history {
+		assert.Equal(t, uint64(count-i), m.Seq)
+	}
+
+	status, _ = get("/api/messages/range?participants=" + channel + "&from_seq=0&to_seq=4")
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = get("/api/messages/range?participants=" + channel + "&from_seq=4&to_seq=2")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	log.Println("Sequence numbers test completed successfully!")
+}
+
+// failingRepo fails every save while fail is set
+type failingRepo struct {
+	repository.Repository
+	fail atomic.Bool
+}
+
+func (r *failingRepo) Save(ctx context.Context, m *models.Message) error {
+	if r.fail.Load() {
+		return fmt.Errorf("save failed")
+	}
+	return r.Repository.Save(ctx, m)
+}
+
+func TestPersistThenBroadcast(t *testing.T) {
+	mongoRepo, err := repository.NewMongoRepository(mongoURITest, dbNameTest, collectionTest+"_persist")
+	if err != nil {
+		t.Skip("Skipping test: MongoDB not available")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mongoRepo.Drop(ctx)
+	repo := &failingRepo{Repository: mongoRepo}
+
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.MaxRetries = 2
+	cfg.DeliveryMode = service.PersistThenBroadcast
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+	router := http.NewServeMux()
+	router.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(handler.HandleWebsocket)))
+	router.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage)))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 229, &wg)
+	recipient := NewSimulatedUser(t, 230, &wg)
+	participants := []string{sender.ID, recipient.ID}
+	recipient.Connect(server.URL)
+	defer recipient.Close()
+	waitForConnections(t, hub, []string{recipient.ID}, 1)
+
+	sendTo := func(serverURL, content, clientMsgID string) (int, *models.Message) {
+		payload := fmt.Sprintf(`{"participants": ["%s", "%s"], "content": "%s", "client_msg_id": "%s"}`, sender.ID, recipient.ID, content, clientMsgID)
+		req, _ := http.NewRequest("POST", serverURL+"/api/messages", strings.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+sender.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var msg models.Message
+		json.NewDecoder(resp.Body).Decode(&msg)
+		return resp.StatusCode, &msg
+	}
+	send := func(content, clientMsgID string) (int, *models.Message) {
+		return sendTo(server.URL, content, clientMsgID)
+	}
+
+	// The message is stored by the time the 201 arrives
+	wg.Add(1)
+	status, stored := send("persisted first", "persist-1")
+	require.Equal(t, http.StatusCreated, status)
+	assert.Len(t, stored.ID, 26)
+	assert.Equal(t, uint64(1), stored.Seq)
+	assert.Equal(t, "persisted first", stored.Content)
+
+	history, err := mongoRepo.GetMessagesByParticipants(ctx, participants)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, stored.ID, history[0].ID)
+
+	waitTimeout(&wg, 5*time.Second, t)
+	msg := <-recipient.Received
+	assert.Equal(t, stored.ID, msg.ID)
+
+	// A retry returns the stored message
+	status, retry := send("persisted first", "persist-1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, stored.ID, retry.ID)
+
+	// So does a retry reaching another instance, without broadcasting it
+	replicaHub := ws.NewHub(ws.DefaultConfig())
+	go replicaHub.Run()
+	defer replicaHub.Stop()
+	replica := service.NewChatServiceWithConfig(repo, replicaHub, cfg)
+	defer replica.Stop()
+	replicaRouter := http.NewServeMux()
+	replicaRouter.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(httpapi.NewHandler(replica, nil).HandleSendMessage)))
+	replicaServer := httptest.NewServer(replicaRouter)
+	defer replicaServer.Close()
+
+	status, retry = sendTo(replicaServer.URL, "persisted first", "persist-1")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, stored.ID, retry.ID)
+	assert.Equal(t, stored.Seq, retry.Seq)
+	history, err = mongoRepo.GetMessagesByParticipants(ctx, participants)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// A retry whose lookup misses the stored message is numbered before the
+	// insert finds the clash; a placeholder keeps that number
+	racing := service.NewChatServiceWithConfig(&staleLookupRepo{Repository: repo}, replicaHub, cfg)
+	defer racing.Stop()
+	accepted, duplicate, err := racing.BroadcastMessage(ctx, &models.Message{
+		Sender:       sender.ID,
+		ClientMsgID:  "persist-1",
+		Content:      "persisted first",
+		CreatedAt:    time.Now(),
+		Participants: participants,
+	}, "")
+	require.NoError(t, err)
+	assert.True(t, duplicate)
+	assert.Equal(t, stored.ID, accepted.ID)
+	placeholder, err := mongoRepo.GetMessagesBySeqRange(ctx, participants, 2, 2, 10)
+	require.NoError(t, err)
+	require.Len(t, placeholder, 1, "Expected a placeholder for the retry's seq")
+	assert.Equal(t, stored.ID, placeholder[0].DuplicateOf)
+	history, err = mongoRepo.GetMessagesByParticipants(ctx, participants)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+
+	// A message that can't be stored is never broadcast
+	repo.fail.Store(true)
+	status, _ = send("never stored", "persist-2")
+	assert.Equal(t, http.StatusInternalServerError, status)
+	time.Sleep(200 * time.Millisecond)
+	assert.Empty(t, recipient.Received, "Unstored message was broadcast")
+
+	// Once saves work again the failed send can be retried
+	repo.fail.Store(false)
+	wg.Add(1)
+	status, _ = send("never stored", "persist-2")
+	assert.Equal(t, http.StatusCreated, status)
+	waitTimeout(&wg, 5*time.Second, t)
+
+	log.Println("Persist then broadcast test completed successfully!")
+}
+
+// staleLookupRepo doesn't find a sender's message by client_msg_id the first
+// time, as if another instance stored it right after the lookup
+type staleLookupRepo struct {
+	repository.Repository
+	looked atomic.Bool
+}
+
+func (r *staleLookupRepo) GetMessageByClientMsgID(ctx context.Context, sender, clientMsgID string) (*models.Message, error) {
+	if !r.looked.Swap(true) {
+		return nil, repository.ErrMessageNotFound
+	}
+	return r.Repository.GetMessageByClientMsgID(ctx, sender, clientMsgID)
+}
+
+// flakyBatchRepo stores only every other message of a batch on its first
+// attempt and reports the rest as failed
+type flakyBatchRepo struct {
+	repository.Repository
+	mu      sync.Mutex
+	batches []int
+}
+
+func (r *flakyBatchRepo) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	r.mu.Lock()
+	first := len(r.batches) == 0
+	r.batches = append(r.batches, len(msgs))
+	r.mu.Unlock()
+	if !first {
+		return r.Repository.SaveBatch(ctx, msgs)
+	}
+
+	batchErr := &repository.BatchError{Errors: map[int]error{}}
+	var stored []*models.Message
+	for i, m := range msgs {
+		if i%2 == 0 {
+			stored = append(stored, m)
+		} else {
+			batchErr.Errors[i] = fmt.Errorf("write failed")
+		}
+	}
+	if err := r.Repository.SaveBatch(ctx, stored); err != nil {
+		return err
+	}
+	if len(batchErr.Errors) == 0 {
+		return nil
+	}
+	return batchErr
+}
+
+func TestBatchedPersistence(t *testing.T) {
+	mongoRepo, err := repository.NewMongoRepository(mongoURITest, dbNameTest, collectionTest+"_batch")
+	if err != nil {
+		t.Skip("Skipping test: MongoDB not available")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mongoRepo.Drop(ctx)
+	repo := &flakyBatchRepo{Repository: mongoRepo}
+
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.SaveBatchSize = 10
+	cfg.SaveBatchDelay = 100 * time.Millisecond
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+
+	const count = 40
+	participants := []string{"user-231", "user-232"}
+	for i := 0; i < count; i++ {
+		_, _, err := svc.BroadcastMessage(context.Background(), &models.Message{
+			Sender:       participants[0],
+			Content:      fmt.Sprintf("batched %d", i),
+			CreatedAt:    time.Now(),
+			Participants: participants,
+		}, "")
+		require.NoError(t, err)
+	}
+
+	// Every message is stored exactly once, including those that failed in
+	// the first batch
+	require.Eventually(t, func() bool {
+		stored, err := mongoRepo.GetMessagesByParticipants(ctx, participants)
+		return err == nil && len(stored) == count
+	}, 5*time.Second, 50*time.Millisecond, "Expected all %d messages to be stored", count)
+
+	stored, err := mongoRepo.GetMessagesByParticipants(ctx, participants)
+	require.NoError(t, err)
+	seen := make(map[string]bool)
+	for _, m := range stored {
+		assert.False(t, seen[m.Content], "%q stored twice", m.Content)
+		seen[m.Content] = true
+	}
+
+	// Workers wrote in batches, and the retry only carried the failed half
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Greater(t, repo.batches[0], 1, "Expected messages to be batched")
+	assert.LessOrEqual(t, slices.Max(repo.batches), cfg.SaveBatchSize)
+	assert.Less(t, len(repo.batches), count, "Expected fewer inserts than messages")
+	total := 0
+	for _, n := range repo.batches {
+		total += n
+	}
+	assert.Equal(t, count+repo.batches[0]/2, total, "Expected only failed messages to be retried")
+
+	log.Println("Batched persistence test completed successfully!")
+}
+
+// blockingRepo holds every save until release is closed or its context is
+// done
+type blockingRepo struct {
+	latencyRepo
+	release chan struct{}
+}
+
+func (r *blockingRepo) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	select {
+	case <-r.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.latencyRepo.SaveBatch(ctx, msgs)
+}
+
+// stalledSeqRepo never hands out a sequence number before the caller gives
+// up
+type stalledSeqRepo struct {
+	latencyRepo
+}
+
+func (r *stalledSeqRepo) NextSeq(ctx context.Context, _ string) (uint64, error) {
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func TestSaturatedPipeline(t *testing.T) {
+	repo := &blockingRepo{release: make(chan struct{})}
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.DBWorkers = 1
+	cfg.DBQueueSize = 2
+	cfg.SaveBatchSize = 1
+	cfg.EnqueueTimeout = 100 * time.Millisecond
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+	router := http.NewServeMux()
+	router.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage)))
+	router.HandleFunc("/api/admin/queues", handler.HandleGetQueueStats)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 233, &wg)
+	send := func() (*http.Response, time.Duration) {
+		payload := fmt.Sprintf(`{"participants": ["%s"], "content": "saturated"}`, sender.ID)
+		req, _ := http.NewRequest("POST", server.URL+"/api/messages", strings.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+sender.Token)
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp, time.Since(start)
+	}
+
+	// The worker holds one message and the queue two more; the next send
+	// waits for the enqueue timeout and is turned away
+	var rejected *http.Response
+	var waited time.Duration
+	accepted := 0
+	for i := 0; i < 10 && rejected == nil; i++ {
+		resp, elapsed := send()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			rejected, waited = resp, elapsed
+			continue
+		}
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		accepted++
+	}
+	require.NotNil(t, rejected, "Expected a send to be rejected while the DB queue is full")
+	assert.Equal(t, "1", rejected.Header.Get("Retry-After"))
+	assert.Less(t, waited, time.Second, "Rejected send waited too long")
+
+	resp, err := http.Get(server.URL + "/api/admin/queues")
+	require.NoError(t, err)
+	var stats service.QueueStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	resp.Body.Close()
+	assert.Equal(t, 2, stats.DBQueueDepth)
+	assert.Equal(t, 2, stats.DBQueueCapacity)
+	assert.Equal(t, 1, stats.DBWorkers)
+	assert.GreaterOrEqual(t, stats.Rejected, uint64(1))
+
+	// Stopping stores every accepted message, the queued ones included
+	close(repo.release)
+	svc.Stop()
+	assert.Equal(t, int64(accepted), repo.saved.Load(), "Expected Stop to store the queue")
+
+	// Messages that can't be stored in time are counted as dropped: the
+	// one being saved as failed, the one still queued as lost to shutdown
+	hungMetrics := metrics.New()
+	hungCfg := cfg
+	hungCfg.Metrics = hungMetrics
+	hungSvc := service.NewChatServiceWithConfig(&blockingRepo{release: make(chan struct{})}, hub, hungCfg)
+	for i := 0; i < 2; i++ {
+		_, _, err := hungSvc.BroadcastMessage(context.Background(), &models.Message{
+			Sender:       sender.ID,
+			Content:      "never stored",
+			Participants: []string{sender.ID},
+		}, "")
+		require.NoError(t, err)
+	}
+	hungSvc.Stop()
+	rec := httptest.NewRecorder()
+	hungMetrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(t, rec.Body.String(), `chat_messages_dropped_total{reason="save_failed"} 1`)
+	assert.Contains(t, rec.Body.String(), `chat_messages_dropped_total{reason="shutdown"} 1`)
+
+	// Numbering waits no longer than queueing: a repository that doesn't
+	// hand out sequence numbers turns sends away after the enqueue timeout
+	unnumbered := service.NewChatServiceWithConfig(&stalledSeqRepo{}, hub, cfg)
+	defer unnumbered.Stop()
+	start := time.Now()
+	_, _, err = unnumbered.BroadcastMessage(context.Background(), &models.Message{
+		Sender:       sender.ID,
+		Content:      "unnumbered",
+		Participants: []string{sender.ID},
+	}, "")
+	assert.ErrorIs(t, err, service.ErrOverloaded)
+	assert.Less(t, time.Since(start), time.Second, "Numbering waited too long")
+
+	// A hub whose shard queues are full doesn't hold up accepted sends
+	stalledCfg := ws.DefaultConfig()
+	stalledCfg.Shards = 1
+	stalledCfg.ShardQueueSize = 1
+	stalledHub := ws.NewHub(stalledCfg) // never run, so its queue never drains
+	stalledSvc := service.NewChatServiceWithConfig(&latencyRepo{}, stalledHub, cfg)
+	defer stalledSvc.Stop()
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		_, _, err := stalledSvc.BroadcastMessage(context.Background(), &models.Message{
+			Sender:       sender.ID,
+			Content:      "stalled hub",
+			Participants: []string{sender.ID},
+		}, "")
+		assert.NoError(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	}
+	assert.Equal(t, uint64(1), stalledSvc.QueueStats().BroadcastTimeouts)
+
+	log.Println("Saturated pipeline test completed successfully!")
+}
+
+// contextRepo records the request-scoped values that reach the repository
+// and holds history queries until their context is done
+type contextRepo struct {
+	latencyRepo
+	mu       sync.Mutex
+	seen     []string
+	canceled chan error
+}
+
+func (r *contextRepo) record(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = append(r.seen, reqctx.RequestID(ctx)+"/"+reqctx.UserID(ctx))
+}
+
+func (r *contextRepo) NextSeq(ctx context.Context, channelID string) (uint64, error) {
+	r.record(ctx)
+	return r.latencyRepo.NextSeq(ctx, channelID)
+}
+
+func (r *contextRepo) Save(ctx context.Context, m *models.Message) error {
+	r.record(ctx)
+	return r.latencyRepo.Save(ctx, m)
+}
+
+func (r *contextRepo) GetMessagesByParticipantsWithPagination(ctx context.Context, participants []string, page, size int) ([]*models.Message, error) {
+	<-ctx.Done()
+	r.canceled <- ctx.Err()
+	return nil, ctx.Err()
+}
+
+func TestRequestContextPropagation(t *testing.T) {
+	repo := &contextRepo{canceled: make(chan error, 1)}
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.DeliveryMode = service.PersistThenBroadcast
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+	router := http.NewServeMux()
+	router.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage)))
+	router.Handle("/api/messages/history", authMiddleware.Verify(http.HandlerFunc(handler.HandleGetMessages)))
+	server := httptest.NewServer(middleware.RequestID(router))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 234, &wg)
+	send := func(requestID string) *http.Response {
+		payload := fmt.Sprintf(`{"participants": ["%s"], "content": "traced"}`, sender.ID)
+		req, _ := http.NewRequest("POST", server.URL+"/api/messages", strings.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+sender.Token)
+		if requestID != "" {
+			req.Header.Set("X-Request-ID", requestID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusCreated, resp.StatusCode)
+		return resp
+	}
+
+	// The caller's request id and the authenticated user reach the
+	// repository, and the id is echoed back
+	resp := send("client-chosen-id")
+	assert.Equal(t, "client-chosen-id", resp.Header.Get("X-Request-ID"))
+
+	// Requests without a usable id get a generated one
+	resp = send("not a valid id")
+	generated := resp.Header.Get("X-Request-ID")
+	assert.NotEmpty(t, generated)
+	assert.NotEqual(t, "not a valid id", generated)
+
+	repo.mu.Lock()
+	assert.Equal(t, []string{
+		"client-chosen-id/" + sender.ID, "client-chosen-id/" + sender.ID,
+		generated + "/" + sender.ID, generated + "/" + sender.ID,
+	}, repo.seen)
+	repo.mu.Unlock()
+
+	// A client giving up on a history request cancels the query
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	req, _ := http.NewRequest("GET", server.URL+"/api/messages/history?participants="+sender.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+sender.Token)
+	_, err := client.Do(req)
+	require.Error(t, err)
+
+	select {
+	case err := <-repo.canceled:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(2 * time.Second):
+		t.Fatal("History query was not canceled after the client went away")
+	}
+
+	log.Println("Request context propagation test completed successfully!")
+}
+
+// outageRepo fails saves and history reads while down is set
+type outageRepo struct {
+	latencyRepo
+	down  atomic.Bool
+	calls atomic.Int64
+}
+
+func (r *outageRepo) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	r.calls.Add(1)
+	if r.down.Load() {
+		return fmt.Errorf("connection refused")
+	}
+	return r.latencyRepo.SaveBatch(ctx, msgs)
+}
+
+func (r *outageRepo) GetMessagesByParticipantsWithPagination(ctx context.Context, participants []string, page, size int) ([]*models.Message, error) {
+	r.calls.Add(1)
+	if r.down.Load() {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return []*models.Message{}, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	repo := &outageRepo{}
+	breaker := repository.NewCircuitBreaker(repo, repository.BreakerConfig{
+		FailureThreshold: 3,
+		OpenTimeout:      500 * time.Millisecond,
+	})
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.SaveBatchSize = 1
+	svc := service.NewChatServiceWithConfig(breaker, hub, cfg)
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+	router := http.NewServeMux()
+	router.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage)))
+	router.Handle("/api/messages/history", authMiddleware.Verify(http.HandlerFunc(handler.HandleGetMessages)))
+	router.HandleFunc("/api/admin/storage", handler.HandleGetStorageStats)
+	router.HandleFunc("/health", handler.Health)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 235, &wg)
+	do := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	history := func() *http.Response {
+		return do("GET", "/api/messages/history?participants="+user.ID, "")
+	}
+	storage := func() repository.BreakerStats {
+		resp, err := http.Get(server.URL + "/api/admin/storage")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var stats repository.BreakerStats
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+		return stats
+	}
+	health := func() map[string]string {
+		resp, err := http.Get(server.URL + "/health")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return body
+	}
+
+	// A queued message whose saves trip the circuit waits for it to close
+	// instead of using up its attempts
+	repo.down.Store(true)
+	resp := do("POST", "/api/messages", fmt.Sprintf(`{"participants": ["%s"], "content": "during outage"}`, user.ID))
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	require.Eventually(t, func() bool {
+		return storage().State == repository.BreakerOpen
+	}, 5*time.Second, 10*time.Millisecond, "Expected failed saves to open the circuit")
+
+	// While open, reads and sends fail fast without touching the database
+	calls := repo.calls.Load()
+	resp = history()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "5", resp.Header.Get("Retry-After"))
+	resp = do("POST", "/api/messages", fmt.Sprintf(`{"participants": ["%s"], "content": "rejected"}`, user.ID))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, calls, repo.calls.Load(), "Open circuit called the database")
+
+	assert.Equal(t, map[string]string{"status": "degraded", "storage": "open"}, map[string]string{
+		"status": health()["status"], "storage": health()["storage"],
+	})
+	stats := storage()
+	assert.GreaterOrEqual(t, stats.Trips, uint64(1))
+	assert.GreaterOrEqual(t, stats.Rejected, uint64(2))
+	assert.NotNil(t, stats.OpenedAt)
+
+	// Once the database is back a probe closes the circuit and the queued
+	// message is stored
+	repo.down.Store(false)
+	require.Eventually(t, func() bool {
+		return repo.saved.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond, "Expected the queued message to be stored after recovery")
+	assert.Equal(t, repository.BreakerClosed, storage().State)
+	assert.Equal(t, "ok", health()["status"])
+	assert.Equal(t, http.StatusOK, history().StatusCode)
+
+	// A failing probe reopens the circuit for another timeout
+	trips := storage().Trips
+	repo.down.Store(true)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusInternalServerError, history().StatusCode)
+	}
+	assert.Equal(t, http.StatusServiceUnavailable, history().StatusCode)
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, http.StatusInternalServerError, history().StatusCode, "Expected the probe to reach the database")
+	assert.Equal(t, http.StatusServiceUnavailable, history().StatusCode)
+	assert.Equal(t, trips+2, storage().Trips)
+
+	// Messages the database rejects for good don't open the circuit
+	rejecting := repository.NewCircuitBreaker(&rejectingRepo{}, repository.BreakerConfig{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Minute,
+	})
+	for i := 0; i < 3; i++ {
+		err := rejecting.SaveBatch(context.Background(), []*models.Message{{ID: fmt.Sprint(i)}})
+		require.Error(t, err)
+	}
+	assert.Equal(t, repository.BreakerClosed, rejecting.Stats().State)
+	assert.Zero(t, rejecting.Stats().ConsecutiveFailures)
+
+	// Stop ends the wait of a batch for a circuit that stays open
+	stuckRepo := &outageRepo{}
+	stuckRepo.down.Store(true)
+	stuck := repository.NewCircuitBreaker(stuckRepo, repository.BreakerConfig{
+		FailureThreshold: 1,
+		OpenTimeout:      time.Minute,
+	})
+	stuckMetrics := metrics.New()
+	stuckCfg := service.DefaultConfig()
+	stuckCfg.SaveBatchSize = 1
+	stuckCfg.Metrics = stuckMetrics
+	stuckSvc := service.NewChatServiceWithConfig(stuck, hub, stuckCfg)
+	_, _, err := stuckSvc.BroadcastMessage(context.Background(), &models.Message{
+		Sender:       user.ID,
+		Content:      "stuck",
+		CreatedAt:    time.Now(),
+		Participants: []string{user.ID},
+	}, "")
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return stuck.Stats().State == repository.BreakerOpen
+	}, 5*time.Second, 10*time.Millisecond)
+	stuckSvc.Stop()
+	require.Eventually(t, func() bool {
+		rec := httptest.NewRecorder()
+		stuckMetrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return strings.Contains(rec.Body.String(), `chat_messages_dropped_total{reason="save_failed"} 1`)
+	}, 5*time.Second, 10*time.Millisecond, "Expected Stop to end the wait for the circuit")
+
+	log.Println("Circuit breaker test completed successfully!")
+}
+
+// rejectingRepo fails every message of a batch validation
+type rejectingRepo struct {
+	latencyRepo
+}
+
+func (r *rejectingRepo) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	batchErr := &repository.BatchError{Errors: map[int]error{}}
+	for i := range msgs {
+		batchErr.Errors[i] = mongo.WriteError{Index: i, Code: 121, Message: "Document failed validation"}
+	}
+	return batchErr
+}
+
+// classifyingRepo fails the first batch with one permanent and one
+// transient error
+type classifyingRepo struct {
+	latencyRepo
+	mu      sync.Mutex
+	batches [][]string
+}
+
+func (r *classifyingRepo) SaveBatch(ctx context.Context, msgs []*models.Message) error {
+	r.mu.Lock()
+	contents := make([]string, len(msgs))
+	for i, m := range msgs {
+		contents[i] = m.Content
+	}
+	r.batches = append(r.batches, contents)
+	first := len(r.batches) == 1
+	r.mu.Unlock()
+	if !first || len(msgs) != 2 {
+		return r.latencyRepo.SaveBatch(ctx, msgs)
+	}
+	return &repository.BatchError{Errors: map[int]error{
+		0: mongo.WriteError{Index: 0, Code: 121, Message: "Document failed validation"},
+		1: mongo.WriteError{Index: 1, Code: 112, Message: "WriteConflict"},
+	}}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// Delays grow exponentially up to the maximum
+	policy := retry.Policy{InitialInterval: 10 * time.Millisecond, MaxInterval: 40 * time.Millisecond, Multiplier: 2}
+	for attempt, want := range []time.Duration{10, 20, 40, 40} {
+		assert.Equal(t, want*time.Millisecond, policy.Interval(attempt+1))
+	}
+	// and without bound when there is no maximum
+	unbounded := retry.Policy{InitialInterval: 10 * time.Millisecond, Multiplier: 2}
+	for attempt, want := range []time.Duration{10, 20, 40, 80} {
+		assert.Equal(t, want*time.Millisecond, unbounded.Interval(attempt+1))
+	}
+
+	// The elapsed time bounds attempts that have no count limit
+	policy.Jitter = 0.5
+	policy.MaxElapsedTime = 100 * time.Millisecond
+	calls := 0
+	start := time.Now()
+	err := retry.Do(context.Background(), policy, nil, func(context.Context) error {
+		calls++
+		return fmt.Errorf("unavailable")
+	})
+	assert.EqualError(t, err, "unavailable")
+	assert.GreaterOrEqual(t, calls, 3)
+	assert.Less(t, time.Since(start), 150*time.Millisecond)
+
+	// Permanent errors aren't retried
+	calls = 0
+	validation := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121, Message: "Document failed validation"}}}
+	err = retry.Do(context.Background(), retry.DefaultPolicy(), repository.Retryable, func(context.Context) error {
+		calls++
+		return validation
+	})
+	assert.ErrorAs(t, err, &mongo.WriteException{})
+	assert.Equal(t, 1, calls)
+
+	// Waiting ends with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = retry.Do(ctx, retry.Policy{InitialInterval: time.Second}, nil, func(context.Context) error {
+		return fmt.Errorf("unavailable")
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("server selection timeout"), true},
+		{repository.ErrDuplicateMessage, false},
+		{context.Canceled, false},
+		{repository.ErrCircuitOpen, true},
+		{validation, false},
+		{mongo.CommandError{Code: 189, Name: "PrimarySteppedDown"}, true},
+		{mongo.CommandError{Code: 2, Labels: []string{"RetryableWriteError"}}, true},
+		{mongo.CommandError{Code: 13, Name: "Unauthorized"}, false},
+		{&repository.BatchError{Errors: map[int]error{0: repository.ErrDuplicateMessage}}, false},
+		{mongo.ErrUnacknowledgedWrite, false},
+		{&repository.BatchError{Errors: map[int]error{0: mongo.WriteError{Code: 121}, 1: mongo.WriteError{Code: 112}}}, true},
+		{&repository.BatchError{Errors: map[int]error{0: mongo.WriteError{Code: 121}}}, false},
+		// InsertMany reports its failures as a bulk write exception
+		{mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: 112}}}}, true},
+		{mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: 121}}}}, false},
+		{mongo.BulkWriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}}, true},
+	} {
+		assert.Equal(t, tc.retryable, repository.Retryable(tc.err), "%v", tc.err)
+	}
+
+	// Unacknowledged writes are refused up front
+	assert.Error(t, repository.WriteConcern{W: "0"}.Validate())
+	assert.NoError(t, repository.WriteConcern{W: "majority", Journal: true}.Validate())
+	_, err = repository.NewMongoRepositoryWithOptions(mongoURITest, dbNameTest, collectionTest, repository.MongoOptions{WriteConcern: repository.WriteConcern{W: "0"}})
+	assert.ErrorContains(t, err, "w=0")
+
+	// DB workers drop messages that failed for good and retry the others
+	repo := &classifyingRepo{}
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.DBWorkers = 1
+	cfg.SaveBatchDelay = 50 * time.Millisecond
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+
+	for _, content := range []string{"invalid", "conflicting"} {
+		_, _, err := svc.BroadcastMessage(context.Background(), &models.Message{
+			Sender:       "user-236",
+			Content:      content,
+			Participants: []string{"user-236"},
+		}, "")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return repo.saved.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond, "Expected the transient failure to be retried")
+	time.Sleep(300 * time.Millisecond)
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Equal(t, [][]string{{"invalid", "conflicting"}, {"conflicting"}}, repo.batches)
+
+	log.Println("Retry policy test completed successfully!")
+}
+
+// pingRepo holds saves like blockingRepo and fails pings while down is set
+type pingRepo struct {
+	blockingRepo
+	down atomic.Bool
+}
+
+func (r *pingRepo) Ping(context.Context) error {
+	if r.down.Load() {
+		return fmt.Errorf("no reachable servers")
+	}
+	return nil
+}
+
+type readiness struct {
+	Status     string `json:"status"`
+	Components map[string]struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"components"`
+}
+
+func TestReadiness(t *testing.T) {
+	repo := &pingRepo{blockingRepo: blockingRepo{release: make(chan struct{})}}
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	cfg := service.DefaultConfig()
+	cfg.DBWorkers = 1
+	cfg.DBQueueSize = 2
+	cfg.SaveBatchSize = 1
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+	defer close(repo.release)
+
+	store := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: store.Addr()})
+	defer client.Close()
+
+	handler := httpapi.NewHandler(svc, nil)
+	handler.AddReadinessCheck("redis", func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
+	})
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	requireAdmin := middleware.RequireScopes(middleware.ScopeAdmin)
+	router := http.NewServeMux()
+	router.HandleFunc("/livez", handler.Livez)
+	router.HandleFunc("/readyz", handler.Readyz)
+	router.Handle("/api/admin/readiness", authMiddleware.Verify(requireAdmin(http.HandlerFunc(handler.ReadinessDetails))))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	adminToken, err := GenerateTestJWTWithScopes("admin-237", jwtSecretTest, middleware.ScopeAdmin)
+	require.NoError(t, err)
+	userToken, err := GenerateTestJWT("user-237", jwtSecretTest)
+	require.NoError(t, err)
+
+	// The public probe only reports the overall status; the components and
+	// their errors are for admins
+	get := func(url, token string) (int, readiness) {
+		req, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var body readiness
+		if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusUnauthorized {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		}
+		return resp.StatusCode, body
+	}
+	ready := func(url string) (int, readiness) {
+		status, body := get(url+"/readyz", "")
+		assert.Empty(t, body.Components, "Expected the public probe not to report components")
+		detailStatus, details := get(url+"/api/admin/readiness", adminToken)
+		assert.Equal(t, status, detailStatus)
+		assert.Equal(t, body.Status, details.Status)
+		return status, details
+	}
+	failing := func(body readiness) []string {
+		var names []string
+		for name, c := range body.Components {
+			if c.Status != "ok" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	status, body := ready(server.URL)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ready", body.Status)
+	assert.ElementsMatch(t, []string{"mongo", "db_queue", "hub", "redis"}, slices.Collect(maps.Keys(body.Components)))
+	assert.Empty(t, failing(body))
+
+	status, _ = get(server.URL+"/api/admin/readiness", userToken)
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = get(server.URL+"/api/admin/readiness", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// Every unhealthy dependency is reported at once
+	repo.down.Store(true)
+	store.Close()
+	for i := 0; i < 3; i++ {
+		_, _, err := svc.BroadcastMessage(context.Background(), &models.Message{
+			Sender:       "user-237",
+			Content:      "stuck",
+			Participants: []string{"user-237"},
+		}, "")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		return svc.QueueStats().DBQueueDepth == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	status, body = ready(server.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "not_ready", body.Status)
+	assert.Equal(t, []string{"db_queue", "mongo", "redis"}, failing(body))
+	assert.Equal(t, "no reachable servers", body.Components["mongo"].Error)
+	assert.Equal(t, "db queue holds 2 of 2 messages", body.Components["db_queue"].Error)
+
+	// Liveness doesn't depend on any of them
+	resp, err := http.Get(server.URL + "/livez")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// A hub whose workers don't run fails its check within the timeout
+	stalledSvc := service.NewChatServiceWithConfig(&latencyRepo{}, ws.NewHub(ws.DefaultConfig()), service.DefaultConfig())
+	defer stalledSvc.Stop()
+	stalledRouter := http.NewServeMux()
+	stalledRouter.HandleFunc("/readyz", httpapi.NewHandler(stalledSvc, nil).Readyz)
+	stalledRouter.HandleFunc("/api/admin/readiness", httpapi.NewHandler(stalledSvc, nil).ReadinessDetails)
+	stalledServer := httptest.NewServer(stalledRouter)
+	defer stalledServer.Close()
+	start := time.Now()
+	status, body = ready(stalledServer.URL)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, []string{"hub"}, failing(body))
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	log.Println("Readiness test completed successfully!")
+}
+
+func TestMetrics(t *testing.T) {
+	repo := &latencyRepo{}
+	// One frame fits the connection's bucket, which barely refills
+	hubCfg := ws.DefaultConfig()
+	hubCfg.ConnFrameRate = rate.Limit(0.01)
+	hubCfg.ConnFrameBurst = 1
+	hub := ws.NewHub(hubCfg)
+	go hub.Run()
+	defer hub.Stop()
+	appMetrics := metrics.New()
+	cfg := service.DefaultConfig()
+	cfg.Metrics = appMetrics
+	svc := service.NewChatServiceWithConfig(repo, hub, cfg)
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	rateLimiter := middleware.NewRateLimiter(rate.Limit(0.01), 2)
+	rateLimiter.SetMetrics(appMetrics, "user")
+	hub.SetMetrics(appMetrics, "ws_frame")
+	handler := httpapi.NewHandler(svc, nil)
+
+	router := http.NewServeMux()
+	router.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(handler.HandleWebsocket)))
+	router.Handle("/api/messages", authMiddleware.Verify(rateLimiter.Middleware(http.HandlerFunc(handler.HandleSendMessage))))
+	router.Handle("GET /metrics", authMiddleware.Verify(middleware.RequireScopes(middleware.ScopeAdmin)(appMetrics.Handler())))
+	routes := []string{"/ws", "/api/messages", "GET /metrics"}
+	server := httptest.NewServer(appMetrics.Middleware(routes, router))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	user := NewSimulatedUser(t, 238, &wg)
+	user.Connect(server.URL)
+	defer user.Close()
+	require.Eventually(t, func() bool {
+		return hub.ConnectionStats().Users == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Two sends fit the burst, the third is rejected
+	wg.Add(2)
+	for i := 0; i < 3; i++ {
+		payload := fmt.Sprintf(`{"participants": ["user-238"], "content": "metrics test %d"}`, i)
+		req, _ := http.NewRequest("POST", server.URL+"/api/messages", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+user.Token)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+	waitTimeout(&wg, 5*time.Second, t)
+	require.Eventually(t, func() bool { return repo.saved.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// WebSocket frames beyond the bucket are dropped and counted, too few
+	// to draw a warning
+	for i := 0; i < 3; i++ {
+		require.NoError(t, user.Conn.WriteMessage(websocket.TextMessage, []byte("frame")))
+	}
+
+	resp, err := http.Get(server.URL + "/api/unknown/42")
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// Metrics need an admin token
+	resp, err = http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	adminToken, err := GenerateTestJWTWithScopes("admin-238", jwtSecretTest, middleware.ScopeAdmin)
+	require.NoError(t, err)
+
+	scrape := func() map[string]string {
+		req, _ := http.NewRequest("GET", server.URL+"/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		series := make(map[string]string)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.LastIndexByte(line, ' '); i > 0 && !strings.HasPrefix(line, "#") {
+				series[line[:i]] = line[i+1:]
+			}
+		}
+		require.NoError(t, scanner.Err())
+		return series
+	}
+
+	require.Eventually(t, func() bool {
+		return scrape()[`chat_rate_limit_rejections_total{scope="ws_frame"}`] == "2"
+	}, 5*time.Second, 10*time.Millisecond)
+	series := scrape()
+	assert.Equal(t, "2", series[`chat_http_requests_total{code="202",method="POST",route="/api/messages"}`])
+	assert.Equal(t, "1", series[`chat_http_requests_total{code="429",method="POST",route="/api/messages"}`])
+	assert.Equal(t, "1", series[`chat_http_requests_total{code="404",method="GET",route="other"}`])
+	assert.Equal(t, "1", series[`chat_rate_limit_rejections_total{scope="user"}`])
+	assert.Equal(t, "2", series["chat_messages_accepted_total"])
+	assert.Equal(t, "2", series["chat_messages_broadcast_total"])
+	assert.Equal(t, "2", series["chat_messages_persisted_total"])
+	assert.Equal(t, "0", series["chat_db_queue_depth"])
+	assert.Equal(t, fmt.Sprint(cfg.DBQueueSize), series["chat_db_queue_capacity"])
+	assert.Equal(t, "1", series[`chat_connections{transport="websocket"}`])
+	assert.Equal(t, "1", series["chat_connected_users"])
+	assert.NotEmpty(t, series[`chat_db_save_duration_seconds_count{op="save_batch"}`])
+	assert.NotEmpty(t, series["go_goroutines"])
+
+	// The WebSocket route is recorded once its connection ends
+	user.Close()
+	require.Eventually(t, func() bool {
+		return hub.ConnectionStats().Users == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		return scrape()[`chat_http_requests_total{code="101",method="GET",route="/ws"}`] == "1"
+	}, 5*time.Second, 10*time.Millisecond)
+	series = scrape()
+	assert.NotEmpty(t, series[`chat_http_requests_total{code="200",method="GET",route="GET /metrics"}`])
+	assert.Equal(t, "0", series[`chat_connections{transport="websocket"}`])
+	assert.Equal(t, "0", series["chat_connected_users"])
+
+	log.Println("Metrics test completed successfully!")
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	_, err := tracing.Setup(context.Background(), tracing.DefaultConfig())
+	require.NoError(t, err)
+
+	repo := &latencyRepo{}
+	hub := ws.NewHub(ws.DefaultConfig())
+	go hub.Run()
+	defer hub.Stop()
+	svc := service.NewChatServiceWithConfig(repository.NewTracingRepository(repo), hub, service.DefaultConfig())
+	defer svc.Stop()
+
+	authMiddleware := middleware.NewAuthMiddleware(jwtSecretTest)
+	handler := httpapi.NewHandler(svc, nil)
+	router := http.NewServeMux()
+	router.Handle("/ws", authMiddleware.Verify(http.HandlerFunc(handler.HandleWebsocket)))
+	router.Handle("/api/messages", authMiddleware.Verify(http.HandlerFunc(handler.HandleSendMessage)))
+	server := httptest.NewServer(tracing.Middleware([]string{"/ws", "/api/messages"}, router))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	sender := NewSimulatedUser(t, 239, &wg)
+	recipient := NewSimulatedUser(t, 240, &wg)
+	sender.Connect(server.URL)
+	defer sender.Close()
+	recipient.Connect(server.URL)
+	defer recipient.Close()
+	require.Eventually(t, func() bool {
+		return hub.ConnectionStats().Users == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The send continues the trace of the caller's traceparent header
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	wg.Add(2)
+	req, _ := http.NewRequest("POST", server.URL+"/api/messages", strings.NewReader(`{"participants": ["user-239", "user-240"], "content": "traced"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+sender.Token)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	waitTimeout(&wg, 5*time.Second, t)
+
+	find := func(name string) []sdktrace.ReadOnlySpan {
+		var found []sdktrace.ReadOnlySpan
+		for _, span := range recorder.Ended() {
+			if span.Name() == name {
+				found = append(found, span)
+			}
+		}
+		return found
+	}
+	require.Eventually(t, func() bool {
+		return len(find("hub.deliver")) == 2 && len(find("repository.SaveBatch")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	requests := find("POST /api/messages")
+	require.Len(t, requests, 1)
+	request := requests[0]
+	assert.Equal(t, traceID, request.SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", request.Parent().SpanID().String())
+	assert.Contains(t, request.Attributes(), attribute.Int("http.response.status_code", http.StatusAccepted))
+
+	childOf := func(parent sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+		spans := find(name)
+		require.Len(t, spans, 1, name)
+		assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID(), name)
+		assert.Equal(t, parent.SpanContext().TraceID(), spans[0].SpanContext().TraceID(), name)
+		return spans[0]
+	}
+	broadcast := childOf(request, "ChatService.BroadcastMessage")
+	childOf(broadcast, "repository.NextSeq")
+	hubBroadcast := childOf(broadcast, "hub.Broadcast")
+
+	// Every recipient's delivery joins the request's trace
+	var delivered []string
+	for _, span := range find("hub.deliver") {
+		assert.Equal(t, hubBroadcast.SpanContext().SpanID(), span.Parent().SpanID())
+		assert.Equal(t, traceID, span.SpanContext().TraceID().String())
+		for _, attr := range span.Attributes() {
+			if attr.Key == "chat.user_id" {
+				delivered = append(delivered, attr.Value.AsString())
+			}
+		}
+	}
+	assert.ElementsMatch(t, []string{"user-239", "user-240"}, delivered)
+
+	// The async save runs in a trace of its own, linked to the send
+	saveBatch := find("ChatService.saveBatch")
+	require.Len(t, saveBatch, 1)
+	assert.NotEqual(t, traceID, saveBatch[0].SpanContext().TraceID().String())
+	require.Len(t, saveBatch[0].Links(), 1)
+	assert.Equal(t, broadcast.SpanContext().SpanID(), saveBatch[0].Links()[0].SpanContext.SpanID())
+	childOf(saveBatch[0], "repository.SaveBatch")
+
+	// Spans can be written to stdout for local testing
+	var out strings.Builder
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{Exporter: tracing.ExporterStdout, ServiceName: "chat-test", SampleRatio: 1, Stdout: &out})
+	require.NoError(t, err)
+	_, span := tracing.Start(context.Background(), "stdout-span")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+	assert.Contains(t, out.String(), `"Name":"stdout-span"`)
+	assert.Contains(t, out.String(), "chat-test")
+
+	_, err = tracing.Setup(context.Background(), tracing.Config{Exporter: "zipkin"})
+	assert.Error(t, err)
+
+	log.Println("Tracing test completed successfully!")
+}
+
+// readSSEMessage reads the next message event from an event stream
+func readSSEMessage(t *testing.T, r *bufio.Reader) (string, *models.Message) {
+	event, id, data := readSSEEvent(t, r)
+	require.Equal(t, "message", event)
+
+	var msg models.Message
+	require.NoError(t, json.Unmarshal([]byte(data), &msg))
+	return id, &msg
+}
+
+// readSSEEvent reads the next event from an event stream, skipping comments
+// and other fields
+func readSSEEvent(t *testing.T, r *bufio.Reader) (event, id, data string) {
+	done := make(chan error, 1)
+	go func() {
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				done <- err
+				return
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "" && data != "":
+				done <- nil
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return event, id, data
+}
+
 // waitTimeout waits for the waitgroup for the specified duration.
 // Returns true if waiting timed out.
 func waitTimeout(wg *sync.WaitGroup, timeout time.Duration, t *testing.T) {
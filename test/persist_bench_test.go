@@ -0,0 +1,130 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chat-microservice/internal/repository"
+	"chat-microservice/internal/service"
+	"chat-microservice/internal/ws"
+	"chat-microservice/pkg/models"
+)
+
+var persistBatchSizes = []int{1, 10, 100, 1000}
+
+func benchMessages(n int) []*models.Message {
+	msgs := make([]*models.Message, n)
+	for i := range msgs {
+		msgs[i] = &models.Message{
+			ID:           models.NewID(),
+			Sender:       "bench-sender",
+			Content:      "bench",
+			CreatedAt:    time.Now(),
+			Participants: []string{"bench-recipient", "bench-sender"},
+		}
+	}
+	return msgs
+}
+
+// BenchmarkPersistRepository compares storing messages one InsertOne at a
+// time with unordered InsertMany batches of several sizes
+func BenchmarkPersistRepository(b *testing.B) {
+	repo, err := repository.NewMongoRepository(mongoURITest, dbNameTest, collectionTest+"_bench")
+	if err != nil {
+		b.Skip("Skipping benchmark: MongoDB not available")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	repo.Drop(ctx)
+
+	b.Run("save", func(b *testing.B) {
+		msgs := benchMessages(b.N)
+		b.ResetTimer()
+		for _, msg := range msgs {
+			if err := repo.Save(context.Background(), msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+	})
+
+	for _, size := range persistBatchSizes[1:] {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			msgs := benchMessages(b.N)
+			b.ResetTimer()
+			for len(msgs) > 0 {
+				n := min(size, len(msgs))
+				if err := repo.SaveBatch(context.Background(), msgs[:n]); err != nil {
+					b.Fatal(err)
+				}
+				msgs = msgs[n:]
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
+
+// latencyRepo stands in for a database that takes the same round trip for
+// every call, however many messages it carries
+type latencyRepo struct {
+	repository.Repository
+	latency time.Duration
+	saved   atomic.Int64
+	seq     atomic.Uint64
+}
+
+func (r *latencyRepo) Save(context.Context, *models.Message) error {
+	time.Sleep(r.latency)
+	r.saved.Add(1)
+	return nil
+}
+
+func (r *latencyRepo) SaveBatch(_ context.Context, msgs []*models.Message) error {
+	time.Sleep(r.latency)
+	r.saved.Add(int64(len(msgs)))
+	return nil
+}
+
+func (r *latencyRepo) NextSeq(context.Context, string) (uint64, error) {
+	return r.seq.Add(1), nil
+}
+
+// BenchmarkPersistWorkers measures how fast the DB workers drain the write
+// queue for several batch sizes when every database call takes 1ms
+func BenchmarkPersistWorkers(b *testing.B) {
+	for _, size := range persistBatchSizes {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			repo := &latencyRepo{latency: time.Millisecond}
+			cfg := ws.DefaultConfig()
+			cfg.LogConnections = false
+			hub := ws.NewHub(cfg)
+			go hub.Run()
+			defer hub.Stop()
+
+			svcCfg := service.DefaultConfig()
+			svcCfg.SaveBatchSize = size
+			svc := service.NewChatServiceWithConfig(repo, hub, svcCfg)
+			defer svc.Stop()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				svc.BroadcastMessage(context.Background(), &models.Message{
+					Sender:       "bench-sender",
+					Content:      "bench",
+					Participants: []string{"bench-sender", "bench-recipient"},
+				}, "")
+			}
+			for repo.saved.Load() < int64(b.N) {
+				runtime.Gosched()
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "msgs/s")
+		})
+	}
+}
@@ -41,6 +41,18 @@ run_race_tests() {
     go test -v -race ./test
 }
 
+# Function to run the hub stress tests with race detection
+run_stress_tests() {
+    echo -e "\n${BLUE}Running hub stress tests with race detection...${NC}"
+    go test -v -race ./test -run TestStress
+}
+
+# Function to run the hub and persistence benchmarks
+run_benchmarks() {
+    echo -e "\n${BLUE}Running hub and persistence benchmarks...${NC}"
+    go test ./test -run xxx -bench 'Hub|Persist' -benchmem
+}
+
 # Function to run tests with coverage
 run_coverage() {
     echo -e "\n${BLUE}Running tests with coverage...${NC}"
@@ -62,8 +74,8 @@ run_specific() {
 # Function to show test statistics
 show_stats() {
     echo -e "\n${BLUE}Test Statistics:${NC}"
-    echo "Number of test functions: $(grep -c "^func Test" test/integration_test.go)"
-    echo "Lines of test code: $(wc -l < test/integration_test.go)"
+    echo "Number of test functions: $(cat test/*_test.go | grep -c "^func Test")"
+    echo "Lines of test code: $(cat test/*_test.go | wc -l)"
     echo ""
 }
 
@@ -76,6 +88,8 @@ if [ $# -eq 0 ]; then
     echo "Commands:"
     echo "  all         - Run all tests"
     echo "  race        - Run tests with race detection"
+    echo "  stress      - Run hub stress tests with race detection"
+    echo "  bench       - Run hub (100k simulated connections) and persistence benchmarks"
     echo "  coverage    - Run tests with coverage report"
     echo "  <name>      - Run a specific test (e.g., TestHighConcurrency)"
     echo "  stats       - Show test statistics"
@@ -92,6 +106,14 @@ else
             check_mongo || exit 1
             run_race_tests
             ;;
+        stress)
+            check_mongo || exit 1
+            run_stress_tests
+            ;;
+        bench)
+            check_mongo || exit 1
+            run_benchmarks
+            ;;
         coverage)
             check_mongo || exit 1
             run_coverage
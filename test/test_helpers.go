@@ -2,14 +2,20 @@ package test
 
 import (
 	"chat-microservice/internal/middleware"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 func GenerateTestJWT(userID, secret string) (string, error) {
+	return GenerateTestJWTWithScopes(userID, secret)
+}
+
+func GenerateTestJWTWithScopes(userID, secret string, scopes ...string) (string, error) {
 	claims := middleware.CustomClaims{
-		ID: userID,
+		ID:    userID,
+		Scope: strings.Join(scopes, " "),
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),